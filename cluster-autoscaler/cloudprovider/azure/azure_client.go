@@ -0,0 +1,171 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+)
+
+// VirtualMachineScaleSetsClient is the interface used by the manager to talk
+// to the VMSS ARM API. It is implemented by azVirtualMachineScaleSetsClient
+// against the real SDK and by VirtualMachineScaleSetsClientMock in tests.
+type VirtualMachineScaleSetsClient interface {
+	Get(ctx context.Context, resourceGroupName string, vmScaleSetName string) (result compute.VirtualMachineScaleSet, err error)
+	List(ctx context.Context, resourceGroupName string) (result []compute.VirtualMachineScaleSet, err error)
+	// CreateOrUpdate applies parameters to vmScaleSetName and returns the VMSS as ARM
+	// persisted it, so callers can pick up a capacity Azure clamped away from what was requested.
+	CreateOrUpdate(ctx context.Context, resourceGroupName string, vmScaleSetName string, parameters compute.VirtualMachineScaleSet) (result compute.VirtualMachineScaleSet, err error)
+	// DeleteInstancesAsync deletes the given instances of vmScaleSetName and returns the VMSS's
+	// post-delete state, so callers can refresh the cached capacity without a separate round trip.
+	DeleteInstancesAsync(ctx context.Context, resourceGroupName string, vmScaleSetName string, vmInstanceIDs compute.VirtualMachineScaleSetVMInstanceRequiredIDs, forceDeletion *bool) (result compute.VirtualMachineScaleSet, err error)
+}
+
+// VirtualMachineScaleSetVMsClient is the interface used by the manager to
+// list/read the individual VM instances that belong to a VMSS.
+type VirtualMachineScaleSetVMsClient interface {
+	Get(ctx context.Context, resourceGroupName string, vmScaleSetName string, instanceID string) (result compute.VirtualMachineScaleSetVM, err error)
+	List(ctx context.Context, resourceGroupName string, vmScaleSetName string) (result []compute.VirtualMachineScaleSetVM, err error)
+}
+
+// VirtualMachinesClient is the interface used by the manager to list the
+// standalone compute.VirtualMachine resources that back a VMSS Flex
+// orchestration group's members.
+type VirtualMachinesClient interface {
+	List(ctx context.Context, resourceGroupName string) (result []compute.VirtualMachine, err error)
+	Delete(ctx context.Context, resourceGroupName string, vmName string) error
+}
+
+// azClient bundles together the ARM clients the manager needs. It is built
+// once from the provider's Config and reused by every registered ScaleSet.
+type azClient struct {
+	virtualMachineScaleSetsClient   VirtualMachineScaleSetsClient
+	virtualMachineScaleSetVMsClient VirtualMachineScaleSetVMsClient
+	virtualMachinesClient           VirtualMachinesClient
+}
+
+// newAzClient builds the real ARM-backed azClient for the given config.
+func newAzClient(cfg *Config) (*azClient, error) {
+	scaleSetsClient := compute.NewVirtualMachineScaleSetsClient(cfg.SubscriptionID)
+	scaleSetVMsClient := compute.NewVirtualMachineScaleSetVMsClient(cfg.SubscriptionID)
+	vmsClient := compute.NewVirtualMachinesClient(cfg.SubscriptionID)
+
+	return &azClient{
+		virtualMachineScaleSetsClient:   &azVirtualMachineScaleSetsClient{client: scaleSetsClient},
+		virtualMachineScaleSetVMsClient: &azVirtualMachineScaleSetVMsClient{client: scaleSetVMsClient},
+		virtualMachinesClient:           &azVirtualMachinesClient{client: vmsClient},
+	}, nil
+}
+
+type azVirtualMachineScaleSetsClient struct {
+	client compute.VirtualMachineScaleSetsClient
+}
+
+func (az *azVirtualMachineScaleSetsClient) Get(ctx context.Context, resourceGroupName string, vmScaleSetName string) (compute.VirtualMachineScaleSet, error) {
+	return az.client.Get(ctx, resourceGroupName, vmScaleSetName)
+}
+
+func (az *azVirtualMachineScaleSetsClient) List(ctx context.Context, resourceGroupName string) ([]compute.VirtualMachineScaleSet, error) {
+	var result []compute.VirtualMachineScaleSet
+	iter, err := az.client.ListComplete(ctx, resourceGroupName)
+	if err != nil {
+		return nil, err
+	}
+	for iter.NotDone() {
+		result = append(result, iter.Value())
+		if err := iter.NextWithContext(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (az *azVirtualMachineScaleSetsClient) CreateOrUpdate(ctx context.Context, resourceGroupName string, vmScaleSetName string, parameters compute.VirtualMachineScaleSet) (compute.VirtualMachineScaleSet, error) {
+	future, err := az.client.CreateOrUpdate(ctx, resourceGroupName, vmScaleSetName, parameters)
+	if err != nil {
+		return compute.VirtualMachineScaleSet{}, err
+	}
+	if err := future.WaitForCompletionRef(ctx, az.client.Client); err != nil {
+		return compute.VirtualMachineScaleSet{}, err
+	}
+	return future.Result(az.client)
+}
+
+func (az *azVirtualMachineScaleSetsClient) DeleteInstancesAsync(ctx context.Context, resourceGroupName string, vmScaleSetName string, vmInstanceIDs compute.VirtualMachineScaleSetVMInstanceRequiredIDs, forceDeletion *bool) (compute.VirtualMachineScaleSet, error) {
+	future, err := az.client.DeleteInstances(ctx, resourceGroupName, vmScaleSetName, vmInstanceIDs)
+	if err != nil {
+		return compute.VirtualMachineScaleSet{}, err
+	}
+	if err := future.WaitForCompletionRef(ctx, az.client.Client); err != nil {
+		return compute.VirtualMachineScaleSet{}, err
+	}
+	// DeleteInstances has no response body, so fetch the VMSS fresh to learn its post-delete capacity.
+	return az.client.Get(ctx, resourceGroupName, vmScaleSetName)
+}
+
+type azVirtualMachineScaleSetVMsClient struct {
+	client compute.VirtualMachineScaleSetVMsClient
+}
+
+func (az *azVirtualMachineScaleSetVMsClient) Get(ctx context.Context, resourceGroupName string, vmScaleSetName string, instanceID string) (compute.VirtualMachineScaleSetVM, error) {
+	return az.client.Get(ctx, resourceGroupName, vmScaleSetName, instanceID, "")
+}
+
+func (az *azVirtualMachineScaleSetVMsClient) List(ctx context.Context, resourceGroupName string, vmScaleSetName string) ([]compute.VirtualMachineScaleSetVM, error) {
+	var result []compute.VirtualMachineScaleSetVM
+	iter, err := az.client.ListComplete(ctx, resourceGroupName, vmScaleSetName, "", "", "")
+	if err != nil {
+		return nil, err
+	}
+	for iter.NotDone() {
+		result = append(result, iter.Value())
+		if err := iter.NextWithContext(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+type azVirtualMachinesClient struct {
+	client compute.VirtualMachinesClient
+}
+
+// List returns every VM in the resource group; callers filter down to the
+// members of a particular VMSS Flex orchestration group by VirtualMachineScaleSet ID.
+func (az *azVirtualMachinesClient) List(ctx context.Context, resourceGroupName string) ([]compute.VirtualMachine, error) {
+	var result []compute.VirtualMachine
+	iter, err := az.client.ListComplete(ctx, resourceGroupName)
+	if err != nil {
+		return nil, err
+	}
+	for iter.NotDone() {
+		result = append(result, iter.Value())
+		if err := iter.NextWithContext(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (az *azVirtualMachinesClient) Delete(ctx context.Context, resourceGroupName string, vmName string) error {
+	future, err := az.client.Delete(ctx, resourceGroupName, vmName)
+	if err != nil {
+		return err
+	}
+	return future.WaitForCompletionRef(ctx, az.client.Client)
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	apiv1 "k8s.io/api/core/v1"
+
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+)
+
+// GPULabel is the label used by Azure to indicate the GPU resource on a node.
+const GPULabel = "accelerator"
+
+// AzureCloudProvider provides implementation of cloudprovider.CloudProvider interface for Azure.
+type AzureCloudProvider struct {
+	azureManager    *AzureManager
+	resourceLimiter *cloudprovider.ResourceLimiter
+}
+
+// BuildAzureCloudProvider creates new AzureCloudProvider.
+func BuildAzureCloudProvider(azureManager *AzureManager, resourceLimiter *cloudprovider.ResourceLimiter) (*AzureCloudProvider, error) {
+	return &AzureCloudProvider{
+		azureManager:    azureManager,
+		resourceLimiter: resourceLimiter,
+	}, nil
+}
+
+// Name returns name of the cloud provider.
+func (azure *AzureCloudProvider) Name() string {
+	return cloudprovider.AzureProviderName
+}
+
+// NodeGroups returns all node groups configured for this cloud provider.
+func (azure *AzureCloudProvider) NodeGroups() []cloudprovider.NodeGroup {
+	return azure.azureManager.GetAsgs()
+}
+
+// NodeGroupForNode returns the node group for the given node.
+func (azure *AzureCloudProvider) NodeGroupForNode(node *apiv1.Node) (cloudprovider.NodeGroup, error) {
+	for _, asg := range azure.azureManager.GetAsgs() {
+		scaleSet, ok := asg.(*ScaleSet)
+		if !ok {
+			continue
+		}
+		belongs, err := scaleSet.Belongs(node)
+		if err != nil {
+			return nil, err
+		}
+		if belongs {
+			return scaleSet, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetResourceLimiter returns struct containing limits (max, min) for resources (cores, memory etc.).
+func (azure *AzureCloudProvider) GetResourceLimiter() (*cloudprovider.ResourceLimiter, error) {
+	return azure.resourceLimiter, nil
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/azure/azuretesting"
+)
+
+// fakeVirtualMachineScaleSetVMID is the providerID of the single fake instance ("0") of
+// the "test-asg" VMSS in the "test" resource group that newTestAzureManager seeds its
+// fake clients' stores with.
+const fakeVirtualMachineScaleSetVMID = azuretesting.FakeVMProviderID
+
+// newTestAzureManager returns an AzureManager wired to in-memory mock clients and
+// pre-populated with a single "test-asg" VMSS (capacity 3) and its one instance, so most
+// tests can exercise ScaleSet methods without an explicit regenerateCache call.
+func newTestAzureManager(t *testing.T) *AzureManager {
+	return azuretesting.GetTestCloud(t)
+}
+
+// newTestProvider returns an AzureCloudProvider backed by newTestAzureManager.
+func newTestProvider(t *testing.T) *AzureCloudProvider {
+	manager := newTestAzureManager(t)
+	resourceLimiter := cloudprovider.NewResourceLimiter(
+		map[string]int64{cloudprovider.ResourceNameCores: 1, cloudprovider.ResourceNameMemory: 10000000},
+		map[string]int64{cloudprovider.ResourceNameCores: 10, cloudprovider.ResourceNameMemory: 100000000})
+	provider, err := BuildAzureCloudProvider(manager, resourceLimiter)
+	assert.NoError(t, err)
+	return provider
+}
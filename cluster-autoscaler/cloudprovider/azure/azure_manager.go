@@ -0,0 +1,317 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	azcache "k8s.io/autoscaler/cluster-autoscaler/cloudprovider/azure/cache"
+)
+
+// defaultCacheTTL is how long a cached VMSS description/instance list is
+// considered fresh before a CacheReadTypeDefault read triggers a refetch.
+const defaultCacheTTL = 2 * time.Minute
+
+const (
+	vmssCacheKeyPrefix           = "vmss"
+	vmssVMCacheKeyPrefix         = "vmssVM"
+	vmssFlexVMCacheKeyPrefix     = "vmssFlexVMs"
+	vmProvisioningStateKeyPrefix = "vmState"
+)
+
+// Config holds the subset of the Azure cloud-provider configuration the
+// manager needs to talk to ARM and scope its registered ScaleSets.
+type Config struct {
+	SubscriptionID string `json:"subscriptionId" yaml:"subscriptionId"`
+	ResourceGroup  string `json:"resourceGroup" yaml:"resourceGroup"`
+}
+
+// AzureManager handles Azure communication and data caching of node groups
+// (Uniform or Flex VMSSes) and their instances.
+type AzureManager struct {
+	config   *Config
+	azClient *azClient
+
+	mutex          sync.Mutex
+	registeredAsgs []cloudprovider.NodeGroup
+
+	// azureCache is the single TimedCache backing VMSS descriptions, VMSS
+	// Uniform instance lists, VMSS Flex member VM lists and per-instance
+	// provisioning states, keyed by a type-prefixed key (see the
+	// vmss*CacheKeyPrefix/vmProvisioningStateKeyPrefix constants).
+	azureCache *azcache.TimedCache
+}
+
+// CreateAzureManager creates the manager for the given config.
+func CreateAzureManager(cfg *Config) (*AzureManager, error) {
+	azClient, err := newAzClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &AzureManager{
+		config:   cfg,
+		azClient: azClient,
+	}
+	m.azureCache = azcache.NewTimedCache(defaultCacheTTL, m.fetchCacheEntry)
+	return m, nil
+}
+
+// NewManagerForTesting builds an AzureManager directly from already-constructed ARM
+// clients, skipping newAzClient's real SDK wiring. It is exported so out-of-package test
+// harnesses (see the azuretesting subpackage) can assemble a manager backed by fakes
+// without needing access to AzureManager's unexported fields.
+func NewManagerForTesting(cfg *Config, vmssClient VirtualMachineScaleSetsClient, vmssVMsClient VirtualMachineScaleSetVMsClient, vmsClient VirtualMachinesClient) *AzureManager {
+	m := &AzureManager{
+		config: cfg,
+		azClient: &azClient{
+			virtualMachineScaleSetsClient:   vmssClient,
+			virtualMachineScaleSetVMsClient: vmssVMsClient,
+			virtualMachinesClient:           vmsClient,
+		},
+	}
+	m.azureCache = azcache.NewTimedCache(defaultCacheTTL, m.fetchCacheEntry)
+	return m
+}
+
+// VMSSClient returns the manager's VirtualMachineScaleSetsClient, for test harnesses
+// that need to reach into the fake backing it.
+func (m *AzureManager) VMSSClient() VirtualMachineScaleSetsClient {
+	return m.azClient.virtualMachineScaleSetsClient
+}
+
+// VMSSVMsClient returns the manager's VirtualMachineScaleSetVMsClient, for test harnesses
+// that need to reach into the fake backing it.
+func (m *AzureManager) VMSSVMsClient() VirtualMachineScaleSetVMsClient {
+	return m.azClient.virtualMachineScaleSetVMsClient
+}
+
+// VMsClient returns the manager's VirtualMachinesClient (VMSS Flex members), for test
+// harnesses that need to reach into the fake backing it.
+func (m *AzureManager) VMsClient() VirtualMachinesClient {
+	return m.azClient.virtualMachinesClient
+}
+
+// Refresh refreshes the cached VMSS/instance state of every registered node group.
+func (m *AzureManager) Refresh() error {
+	return m.regenerateCache()
+}
+
+// RegisterAsg registers a node group if it hasn't been already registered.
+func (m *AzureManager) RegisterAsg(asg cloudprovider.NodeGroup) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, existing := range m.registeredAsgs {
+		if existing.Id() == asg.Id() {
+			return false
+		}
+	}
+	m.registeredAsgs = append(m.registeredAsgs, asg)
+	return true
+}
+
+// GetAsgs returns the list of registered node groups.
+func (m *AzureManager) GetAsgs() []cloudprovider.NodeGroup {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	asgs := make([]cloudprovider.NodeGroup, len(m.registeredAsgs))
+	copy(asgs, m.registeredAsgs)
+	return asgs
+}
+
+// regenerateCache refreshes every registered ScaleSet's orchestration mode
+// and populates its VMSS description / instance list in the cache. It is
+// kept around as a convenience for tests and for priming the cache right
+// after startup; steady-state reads go through getVMSS/getVMSSVMs/
+// getVMProvisioningState with an explicit ReadType instead of calling this.
+func (m *AzureManager) regenerateCache() error {
+	m.mutex.Lock()
+	asgs := make([]cloudprovider.NodeGroup, len(m.registeredAsgs))
+	copy(asgs, m.registeredAsgs)
+	m.mutex.Unlock()
+
+	for _, asg := range asgs {
+		scaleSet, ok := asg.(*ScaleSet)
+		if !ok {
+			continue
+		}
+
+		vmss, err := m.getVMSS(scaleSet.Name, azcache.ReadTypeForceRefresh)
+		if err != nil {
+			return fmt.Errorf("failed to get VMSS %s: %v", scaleSet.Name, err)
+		}
+		scaleSet.setOrchestrationMode(vmss)
+
+		if scaleSet.orchestrationMode == compute.Flexible {
+			if _, err := m.getVmssFlexVMs(scaleSet.Name, azcache.ReadTypeForceRefresh); err != nil {
+				return fmt.Errorf("failed to list VMs for VMSS Flex %s: %v", scaleSet.Name, err)
+			}
+			continue
+		}
+
+		if _, err := m.getVMSSVMs(scaleSet.Name, azcache.ReadTypeForceRefresh); err != nil {
+			return fmt.Errorf("failed to list instances of VMSS %s: %v", scaleSet.Name, err)
+		}
+	}
+	return nil
+}
+
+// getVMSS returns the cached VMSS description for name, per readType.
+func (m *AzureManager) getVMSS(name string, readType azcache.ReadType) (compute.VirtualMachineScaleSet, error) {
+	data, err := m.azureCache.Get(vmssCacheKey(name), readType)
+	if err != nil {
+		return compute.VirtualMachineScaleSet{}, err
+	}
+	return data.(compute.VirtualMachineScaleSet), nil
+}
+
+// getVMSSDeepCopy returns a deep copy of the cached VMSS description for name,
+// per readType, for callers (e.g. IncreaseSize/deleteFlexNodes) that mutate a
+// single field and PUT the result back - a plain getVMSS would hand them a
+// pointer into the cache itself, so mutating it would corrupt what other
+// readers see before the PUT ever reaches ARM.
+func (m *AzureManager) getVMSSDeepCopy(name string, readType azcache.ReadType) (compute.VirtualMachineScaleSet, error) {
+	data, err := m.azureCache.GetWithDeepCopy(vmssCacheKey(name), readType)
+	if err != nil {
+		return compute.VirtualMachineScaleSet{}, err
+	}
+	return data.(compute.VirtualMachineScaleSet), nil
+}
+
+// getVMSSVMs returns the cached Uniform-mode instance list for vmssName, per readType.
+func (m *AzureManager) getVMSSVMs(vmssName string, readType azcache.ReadType) ([]compute.VirtualMachineScaleSetVM, error) {
+	data, err := m.azureCache.Get(vmssVMCacheKey(vmssName), readType)
+	if err != nil {
+		return nil, err
+	}
+	return data.([]compute.VirtualMachineScaleSetVM), nil
+}
+
+// getVmssFlexVMs returns the cached Flex-mode member VM list for vmssName, per readType.
+func (m *AzureManager) getVmssFlexVMs(vmssName string, readType azcache.ReadType) ([]compute.VirtualMachine, error) {
+	data, err := m.azureCache.Get(vmssFlexVMCacheKey(vmssName), readType)
+	if err != nil {
+		return nil, err
+	}
+	return data.([]compute.VirtualMachine), nil
+}
+
+// getVMProvisioningState returns the cached ProvisioningState of a single
+// Uniform-mode instance, per readType. Callers that must never resubmit a
+// delete already in flight (see ScaleSet.DeleteNodes) should pass
+// ReadTypeForceRefresh.
+func (m *AzureManager) getVMProvisioningState(vmssName, instanceID string, readType azcache.ReadType) (string, error) {
+	data, err := m.azureCache.Get(vmProvisioningStateKey(vmssName, instanceID), readType)
+	if err != nil {
+		return "", err
+	}
+	return data.(string), nil
+}
+
+// setCachedVMSS directly injects vmss into the cache, for callers (e.g. after
+// IncreaseSize/DeleteNodes) that already know the post-mutation value and
+// don't need to pay for a live refetch.
+func (m *AzureManager) setCachedVMSS(name string, vmss compute.VirtualMachineScaleSet) {
+	m.azureCache.Set(vmssCacheKey(name), vmss)
+}
+
+// invalidateVMProvisioningState discards the cached ProvisioningState of a
+// single Uniform-mode instance, for callers (e.g. DeleteNodes) that just
+// deleted the instance and don't want its stale cached state to linger until
+// the next ReadTypeForceRefresh.
+func (m *AzureManager) invalidateVMProvisioningState(vmssName, instanceID string) {
+	m.azureCache.Delete(vmProvisioningStateKey(vmssName, instanceID))
+}
+
+func vmssCacheKey(name string) string { return vmssCacheKeyPrefix + "/" + name }
+
+func vmssVMCacheKey(name string) string { return vmssVMCacheKeyPrefix + "/" + name }
+
+func vmssFlexVMCacheKey(name string) string { return vmssFlexVMCacheKeyPrefix + "/" + name }
+
+func vmProvisioningStateKey(vmssName, instanceID string) string {
+	return fmt.Sprintf("%s/%s/%s", vmProvisioningStateKeyPrefix, vmssName, instanceID)
+}
+
+// fetchCacheEntry is the single getter backing azureCache: it dispatches on
+// the key's type prefix to the right ARM call.
+func (m *AzureManager) fetchCacheEntry(key string) (interface{}, error) {
+	ctx := context.Background()
+	parts := strings.SplitN(key, "/", 3)
+
+	switch parts[0] {
+	case vmssCacheKeyPrefix:
+		return m.azClient.virtualMachineScaleSetsClient.Get(ctx, m.config.ResourceGroup, parts[1])
+	case vmssVMCacheKeyPrefix:
+		return m.azClient.virtualMachineScaleSetVMsClient.List(ctx, m.config.ResourceGroup, parts[1])
+	case vmssFlexVMCacheKeyPrefix:
+		return m.listVmssFlexVMs(parts[1])
+	case vmProvisioningStateKeyPrefix:
+		vm, err := m.azClient.virtualMachineScaleSetVMsClient.Get(ctx, m.config.ResourceGroup, parts[1], parts[2])
+		if err != nil {
+			return nil, err
+		}
+		if vm.VirtualMachineScaleSetVMProperties == nil || vm.VirtualMachineScaleSetVMProperties.ProvisioningState == nil {
+			return "", nil
+		}
+		return *vm.VirtualMachineScaleSetVMProperties.ProvisioningState, nil
+	default:
+		return nil, fmt.Errorf("azure: unknown cache key %q", key)
+	}
+}
+
+// listVmssFlexVMs lists the individual compute.VirtualMachine members of a
+// VMSS Flex orchestration group, i.e. the VMs whose virtualMachineScaleSet
+// reference points at this ScaleSet, rather than relying on the VMSS
+// instance-view list used for Uniform mode.
+func (m *AzureManager) listVmssFlexVMs(vmssName string) ([]compute.VirtualMachine, error) {
+	vmssID := m.vmssResourceID(vmssName)
+
+	all, err := m.azClient.virtualMachinesClient.List(context.Background(), m.config.ResourceGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	var members []compute.VirtualMachine
+	for _, vm := range all {
+		if vm.VirtualMachineProperties == nil || vm.VirtualMachineProperties.VirtualMachineScaleSet == nil {
+			continue
+		}
+		if strings.EqualFold(to.String(vm.VirtualMachineProperties.VirtualMachineScaleSet.ID), vmssID) {
+			members = append(members, vm)
+		}
+	}
+	return members, nil
+}
+
+// vmssResourceID builds the ARM resource ID of a VMSS in the manager's
+// configured resource group, used to match VMSS Flex members against their
+// owning scale set.
+func (m *AzureManager) vmssResourceID(vmssName string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s",
+		m.config.SubscriptionID, m.config.ResourceGroup, vmssName)
+}
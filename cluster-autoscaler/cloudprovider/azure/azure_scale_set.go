@@ -0,0 +1,401 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	schedulerframework "k8s.io/kubernetes/pkg/scheduler/framework"
+
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	azcache "k8s.io/autoscaler/cluster-autoscaler/cloudprovider/azure/cache"
+)
+
+// ScaleSet implements cloudprovider.NodeGroup interface for Azure VMSS, in
+// either Uniform or Flexible orchestration mode.
+type ScaleSet struct {
+	azureRef
+	manager *AzureManager
+
+	minSize int
+	maxSize int
+
+	sizeMutex         sync.Mutex
+	sizeRefreshPeriod time.Duration
+	lastSizeRefresh   time.Time
+
+	// orchestrationMode is populated from the VMSS description on every
+	// regenerateCache and determines whether DeleteNodes/Belongs/Nodes use
+	// the Uniform instance-view path or the Flex member-VM path.
+	orchestrationMode compute.OrchestrationMode
+}
+
+// NewScaleSet creates a ScaleSet node group named name, backed by manager, with the
+// given size bounds. Its orchestrationMode is populated on the next manager.Refresh().
+func NewScaleSet(manager *AzureManager, name string, minSize, maxSize int) *ScaleSet {
+	return &ScaleSet{
+		azureRef:          azureRef{Name: name},
+		manager:           manager,
+		minSize:           minSize,
+		maxSize:           maxSize,
+		sizeRefreshPeriod: defaultVmssSizeRefreshPeriod,
+	}
+}
+
+// MaxSize returns maximum size of the node group.
+func (scaleSet *ScaleSet) MaxSize() int {
+	return scaleSet.maxSize
+}
+
+// MinSize returns minimum size of the node group.
+func (scaleSet *ScaleSet) MinSize() int {
+	return scaleSet.minSize
+}
+
+// Id returns ScaleSet id.
+func (scaleSet *ScaleSet) Id() string {
+	return scaleSet.Name
+}
+
+// Debug returns a debug string for the ScaleSet.
+func (scaleSet *ScaleSet) Debug() string {
+	return fmt.Sprintf("%s (%d:%d)", scaleSet.Id(), scaleSet.MinSize(), scaleSet.MaxSize())
+}
+
+// setOrchestrationMode records the orchestration mode reported by the latest
+// VMSS description, defaulting to Uniform for scale sets that predate Flex.
+func (scaleSet *ScaleSet) setOrchestrationMode(vmss compute.VirtualMachineScaleSet) {
+	if vmss.VirtualMachineScaleSetProperties != nil && vmss.VirtualMachineScaleSetProperties.OrchestrationMode == compute.Flexible {
+		scaleSet.orchestrationMode = compute.Flexible
+		return
+	}
+	scaleSet.orchestrationMode = compute.Uniform
+}
+
+// TargetSize returns the current target size of the node group, i.e. the
+// cached VMSS Sku.Capacity. It reads the cache unsafely (whatever's there,
+// even if stale) since this is called on every scale-up/down decision and
+// can't afford to serialize on a live refetch.
+func (scaleSet *ScaleSet) TargetSize() (int, error) {
+	vmss, err := scaleSet.manager.getVMSS(scaleSet.Name, azcache.ReadTypeUnsafe)
+	if err != nil {
+		return -1, err
+	}
+	if vmss.Sku == nil || vmss.Sku.Capacity == nil {
+		return -1, fmt.Errorf("azure: no cached VMSS capacity for %s", scaleSet.Name)
+	}
+	return int(*vmss.Sku.Capacity), nil
+}
+
+// IncreaseSize increases the size of the node group by delta, regardless of
+// the VMSS's current ProvisioningState (e.g. Updating) - scaling continues
+// to make progress even while a previous update is still rolling out.
+func (scaleSet *ScaleSet) IncreaseSize(delta int) error {
+	if delta <= 0 {
+		return fmt.Errorf("size increase must be positive, got: %d", delta)
+	}
+
+	scaleSet.sizeMutex.Lock()
+	defer scaleSet.sizeMutex.Unlock()
+
+	currentSize, err := scaleSet.TargetSize()
+	if err != nil {
+		return err
+	}
+
+	newSize := int64(currentSize + delta)
+	if newSize > int64(scaleSet.MaxSize()) {
+		return fmt.Errorf("size increase too large - desired:%d max:%d", newSize, scaleSet.MaxSize())
+	}
+
+	// CreateOrUpdate is a full-resource PUT, so start from a deep copy of the
+	// cached VMSS and only touch Sku.Capacity - sending a bare Sku-only body
+	// would wipe everything else ARM stores on the scale set.
+	update, err := scaleSet.manager.getVMSSDeepCopy(scaleSet.Name, azcache.ReadTypeUnsafe)
+	if err != nil {
+		return err
+	}
+	if update.Sku == nil {
+		update.Sku = &compute.Sku{}
+	}
+	update.Sku.Capacity = &newSize
+
+	updated, err := scaleSet.manager.azClient.virtualMachineScaleSetsClient.CreateOrUpdate(
+		context.Background(), scaleSet.manager.config.ResourceGroup, scaleSet.Name, update)
+	if err != nil {
+		return err
+	}
+
+	// Use the VMSS CreateOrUpdate returned, rather than newSize, so a capacity Azure
+	// clamped away from what was requested is reflected immediately, instead of racing
+	// the next regenerateCache.
+	scaleSet.manager.setCachedVMSS(scaleSet.Name, updated)
+	return nil
+}
+
+// DeleteNodes deletes the given nodes from the scale set, skipping any
+// instance that is already being deleted to avoid a conflicting request.
+func (scaleSet *ScaleSet) DeleteNodes(nodes []*apiv1.Node) error {
+	if scaleSet.orchestrationMode == compute.Flexible {
+		return scaleSet.deleteFlexNodes(nodes)
+	}
+
+	var toDelete []string
+	for _, node := range nodes {
+		belongs, err := scaleSet.Belongs(node)
+		if err != nil {
+			return err
+		}
+		if !belongs {
+			return fmt.Errorf("%s does not belong to scale set %s", node.Spec.ProviderID, scaleSet.Name)
+		}
+
+		ref, err := parseUniformProviderID(node.Spec.ProviderID)
+		if err != nil {
+			return err
+		}
+
+		if scaleSet.instanceProvisioningState(ref.instanceID) == "Deleting" {
+			continue
+		}
+		toDelete = append(toDelete, ref.instanceID)
+	}
+
+	if len(toDelete) == 0 {
+		return nil
+	}
+
+	updated, err := scaleSet.manager.azClient.virtualMachineScaleSetsClient.DeleteInstancesAsync(
+		context.Background(),
+		scaleSet.manager.config.ResourceGroup,
+		scaleSet.Name,
+		compute.VirtualMachineScaleSetVMInstanceRequiredIDs{InstanceIds: &toDelete},
+		nil)
+	if err != nil {
+		return err
+	}
+
+	// Use the VMSS DeleteInstancesAsync returned so TargetSize reflects the real
+	// post-delete capacity immediately, instead of racing the next regenerateCache.
+	scaleSet.manager.setCachedVMSS(scaleSet.Name, updated)
+
+	// The deleted instances' cached provisioning states are now stale; drop them
+	// rather than risk instanceProvisioningState reporting a ghost instance as
+	// still around until the next ReadTypeForceRefresh.
+	for _, instanceID := range toDelete {
+		scaleSet.manager.invalidateVMProvisioningState(scaleSet.Name, instanceID)
+	}
+	return nil
+}
+
+// deleteFlexNodes deletes the standalone VMs backing a VMSS Flex node group
+// and decrements the VMSS capacity to match. Like DeleteNodes' Uniform path,
+// every node is validated via Belongs before any VM is deleted, so a bad node
+// in the batch fails the whole call without leaving a partial delete behind.
+func (scaleSet *ScaleSet) deleteFlexNodes(nodes []*apiv1.Node) error {
+	var toDelete []string
+	for _, node := range nodes {
+		belongs, err := scaleSet.Belongs(node)
+		if err != nil {
+			return err
+		}
+		if !belongs {
+			return fmt.Errorf("%s does not belong to scale set %s", node.Spec.ProviderID, scaleSet.Name)
+		}
+
+		ref, err := parseFlexProviderID(node.Spec.ProviderID)
+		if err != nil {
+			return err
+		}
+		toDelete = append(toDelete, ref.instanceID)
+	}
+
+	if len(toDelete) == 0 {
+		return nil
+	}
+
+	// Delete is per-instance (Flex has no batched-delete API like Uniform's
+	// DeleteInstancesAsync), so a failure partway through leaves earlier VMs
+	// already gone. Track how many succeeded and decrement capacity by that
+	// count below even on error, so the VMSS capacity doesn't stay wrong by
+	// the deleted count until the next force-refresh.
+	deleted := 0
+	deleteErr := error(nil)
+	for _, instanceID := range toDelete {
+		if deleteErr = scaleSet.manager.azClient.virtualMachinesClient.Delete(
+			context.Background(), scaleSet.manager.config.ResourceGroup, instanceID); deleteErr != nil {
+			break
+		}
+		deleted++
+	}
+
+	if deleted == 0 {
+		return deleteErr
+	}
+
+	currentSize, err := scaleSet.TargetSize()
+	if err != nil {
+		if deleteErr != nil {
+			return deleteErr
+		}
+		return err
+	}
+
+	// CreateOrUpdate is a full-resource PUT, so start from a deep copy of the
+	// cached VMSS and only touch Sku.Capacity - sending a bare Sku-only body
+	// would wipe everything else ARM stores on the scale set.
+	update, err := scaleSet.manager.getVMSSDeepCopy(scaleSet.Name, azcache.ReadTypeUnsafe)
+	if err != nil {
+		if deleteErr != nil {
+			return deleteErr
+		}
+		return err
+	}
+	newSize := int64(currentSize - deleted)
+	if update.Sku == nil {
+		update.Sku = &compute.Sku{}
+	}
+	update.Sku.Capacity = &newSize
+
+	updated, err := scaleSet.manager.azClient.virtualMachineScaleSetsClient.CreateOrUpdate(
+		context.Background(), scaleSet.manager.config.ResourceGroup, scaleSet.Name, update)
+	if err != nil {
+		if deleteErr != nil {
+			return deleteErr
+		}
+		return err
+	}
+	scaleSet.manager.setCachedVMSS(scaleSet.Name, updated)
+	return deleteErr
+}
+
+// instanceProvisioningState fetches the live (ReadTypeForceRefresh)
+// ProvisioningState for the given Uniform-mode instanceID, so a delete
+// already in flight is never resubmitted. It returns "" if the instance or
+// its state is unknown.
+func (scaleSet *ScaleSet) instanceProvisioningState(instanceID string) string {
+	state, err := scaleSet.manager.getVMProvisioningState(scaleSet.Name, instanceID, azcache.ReadTypeForceRefresh)
+	if err != nil {
+		return ""
+	}
+	return state
+}
+
+// Belongs returns true if the given node belongs to this scale set, checking
+// the Uniform VMSS-relative providerID shape or the Flex standalone-VM shape
+// depending on the scale set's orchestration mode.
+func (scaleSet *ScaleSet) Belongs(node *apiv1.Node) (bool, error) {
+	if scaleSet.orchestrationMode == compute.Flexible {
+		ref, err := parseFlexProviderID(node.Spec.ProviderID)
+		if err != nil {
+			return false, err
+		}
+		if !strings.EqualFold(ref.resourceGroup, scaleSet.manager.config.ResourceGroup) {
+			return false, fmt.Errorf("node %q belongs to resource group %q, not %q",
+				node.Spec.ProviderID, ref.resourceGroup, scaleSet.manager.config.ResourceGroup)
+		}
+		vms, err := scaleSet.manager.getVmssFlexVMs(scaleSet.Name, azcache.ReadTypeUnsafe)
+		if err != nil {
+			return false, err
+		}
+		for _, vm := range vms {
+			if vm.Name != nil && strings.EqualFold(*vm.Name, ref.instanceID) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	ref, err := parseUniformProviderID(node.Spec.ProviderID)
+	if err != nil {
+		return false, err
+	}
+	if !strings.EqualFold(ref.resourceGroup, scaleSet.manager.config.ResourceGroup) {
+		return false, fmt.Errorf("node %q belongs to resource group %q, not %q",
+			node.Spec.ProviderID, ref.resourceGroup, scaleSet.manager.config.ResourceGroup)
+	}
+	return strings.EqualFold(ref.vmssName, scaleSet.Name), nil
+}
+
+// Nodes returns the list of instances currently in the scale set, as
+// cloudprovider.Instance with their providerIDs.
+func (scaleSet *ScaleSet) Nodes() ([]cloudprovider.Instance, error) {
+	if scaleSet.orchestrationMode == compute.Flexible {
+		flexVMs, err := scaleSet.manager.getVmssFlexVMs(scaleSet.Name, azcache.ReadTypeUnsafe)
+		if err != nil {
+			return nil, err
+		}
+		instances := make([]cloudprovider.Instance, 0, len(flexVMs))
+		for _, vm := range flexVMs {
+			if vm.ID == nil {
+				continue
+			}
+			instances = append(instances, cloudprovider.Instance{Id: "azure://" + *vm.ID})
+		}
+		return instances, nil
+	}
+
+	cfg := scaleSet.manager.config
+	vms, err := scaleSet.manager.getVMSSVMs(scaleSet.Name, azcache.ReadTypeUnsafe)
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]cloudprovider.Instance, 0, len(vms))
+	for _, vm := range vms {
+		if vm.InstanceID == nil {
+			continue
+		}
+		providerID := fmt.Sprintf("azure:///subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s/virtualMachines/%s",
+			cfg.SubscriptionID, cfg.ResourceGroup, scaleSet.Name, *vm.InstanceID)
+		instances = append(instances, cloudprovider.Instance{Id: providerID})
+	}
+	return instances, nil
+}
+
+// TemplateNodeInfo returns a NodeInfo with a fake, generic node as a
+// template used for scale-from-zero estimations.
+func (scaleSet *ScaleSet) TemplateNodeInfo() (*schedulerframework.NodeInfo, error) {
+	node := &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   fmt.Sprintf("%s-asg-%d", scaleSet.Name, rand.Int63()),
+			Labels: map[string]string{},
+		},
+		Status: apiv1.NodeStatus{
+			Capacity:    apiv1.ResourceList{},
+			Allocatable: apiv1.ResourceList{},
+		},
+	}
+
+	nodeInfo := schedulerframework.NewNodeInfo(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kube-proxy-" + scaleSet.Name,
+			Namespace: "kube-system",
+			Labels:    map[string]string{"k8s-app": "kube-proxy"},
+		},
+	})
+	nodeInfo.SetNode(node)
+	return nodeInfo, nil
+}
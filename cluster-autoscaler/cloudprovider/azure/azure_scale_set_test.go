@@ -17,12 +17,11 @@ limitations under the License.
 package azure
 
 import (
+	"context"
 	"fmt"
-	"net/http"
 	"testing"
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
-	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -30,18 +29,12 @@ import (
 	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/azure/azuretesting"
+	azcache "k8s.io/autoscaler/cluster-autoscaler/cloudprovider/azure/cache"
 )
 
 func newTestScaleSet(manager *AzureManager, name string) *ScaleSet {
-	return &ScaleSet{
-		azureRef: azureRef{
-			Name: name,
-		},
-		manager:           manager,
-		minSize:           1,
-		maxSize:           5,
-		sizeRefreshPeriod: defaultVmssSizeRefreshPeriod,
-	}
+	return NewScaleSet(manager, name, 1, 5)
 }
 
 func TestMaxSize(t *testing.T) {
@@ -97,37 +90,94 @@ func TestIncreaseSize(t *testing.T) {
 }
 
 func TestIncreaseSizeOnVMSSUpdating(t *testing.T) {
+	manager := azuretesting.GetTestCloud(t)
+	scaleSet := azuretesting.RegisterFakeVMSS(t, manager, "vmss-updating", 3, compute.Uniform)
+
+	scaleSetClient := manager.VMSSClient().(*azuretesting.VirtualMachineScaleSetsClientMock)
+	vmss := scaleSetClient.FakeStore[azuretesting.TestResourceGroup]["vmss-updating"]
+	vmss.VirtualMachineScaleSetProperties.ProvisioningState = to.StringPtr(string(compute.ProvisioningStateUpdating))
+	scaleSetClient.FakeStore[azuretesting.TestResourceGroup]["vmss-updating"] = vmss
+	assert.NoError(t, manager.Refresh())
+
+	// Scaling should continue even VMSS is under updating.
+	err := scaleSet.IncreaseSize(1)
+	assert.NoError(t, err)
+}
+
+// TestIncreaseSizePreservesVMSSProperties guards against IncreaseSize sending
+// CreateOrUpdate a bare Sku-only body, which (being a full-resource PUT on
+// real ARM) would wipe every other field - here modeled by Tags and
+// VirtualMachineScaleSetProperties - out of the scale set.
+func TestIncreaseSizePreservesVMSSProperties(t *testing.T) {
+	manager := azuretesting.GetTestCloud(t)
+	scaleSet := azuretesting.RegisterFakeVMSS(t, manager, "vmss-tagged", 2, compute.Uniform)
+
+	scaleSetClient := manager.VMSSClient().(*azuretesting.VirtualMachineScaleSetsClientMock)
+	vmss := scaleSetClient.FakeStore[azuretesting.TestResourceGroup]["vmss-tagged"]
+	vmss.Tags = map[string]*string{"owner": to.StringPtr("team-a")}
+	scaleSetClient.FakeStore[azuretesting.TestResourceGroup]["vmss-tagged"] = vmss
+	assert.NoError(t, manager.Refresh())
+
+	assert.NoError(t, scaleSet.IncreaseSize(1))
+
+	updated := scaleSetClient.FakeStore[azuretesting.TestResourceGroup]["vmss-tagged"]
+	assert.Equal(t, int64(3), *updated.Sku.Capacity)
+	assert.Equal(t, "team-a", *updated.Tags["owner"])
+	assert.Equal(t, compute.Uniform, updated.VirtualMachineScaleSetProperties.OrchestrationMode)
+}
+
+// TestNodesScopedToOwnVMSSWhenSharingResourceGroup guards against the fake
+// VM-list client attributing another Uniform-mode VMSS's instances to this
+// one when both share a resource group (as GetTestCloud's "test-asg" and a
+// second registered VMSS do here).
+func TestNodesScopedToOwnVMSSWhenSharingResourceGroup(t *testing.T) {
+	manager := azuretesting.GetTestCloud(t)
+	scaleSet := azuretesting.RegisterFakeVMSS(t, manager, "vmss-updating", 1, compute.Uniform)
+
+	vmssVMsClient := manager.VMSSVMsClient().(*azuretesting.VirtualMachineScaleSetVMsClientMock)
+	vmssVMsClient.FakeStore[azuretesting.TestResourceGroup]["vmss-updating"] = map[string]compute.VirtualMachineScaleSetVM{
+		"0": {InstanceID: to.StringPtr("0")},
+	}
+	assert.NoError(t, manager.Refresh())
+
+	nodes, err := scaleSet.Nodes()
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+	assert.Contains(t, nodes[0].Id, "vmss-updating")
+}
+
+// clampingScaleSetsClient wraps VirtualMachineScaleSetsClientMock and rewrites
+// whatever capacity CreateOrUpdate is asked to set, simulating Azure clamping
+// the requested capacity down (e.g. on a quota limit).
+type clampingScaleSetsClient struct {
+	*azuretesting.VirtualMachineScaleSetsClientMock
+	clampedCapacity int64
+}
+
+func (c *clampingScaleSetsClient) CreateOrUpdate(ctx context.Context, resourceGroupName string, vmScaleSetName string, parameters compute.VirtualMachineScaleSet) (compute.VirtualMachineScaleSet, error) {
+	parameters.Sku.Capacity = &c.clampedCapacity
+	return c.VirtualMachineScaleSetsClientMock.CreateOrUpdate(ctx, resourceGroupName, vmScaleSetName, parameters)
+}
+
+func TestIncreaseSizeCapacityClamped(t *testing.T) {
 	manager := newTestAzureManager(t)
-	vmssName := "vmss-updating"
-	var vmssCapacity int64 = 3
-	scaleSetClient := &VirtualMachineScaleSetsClientMock{
-		FakeStore: map[string]map[string]compute.VirtualMachineScaleSet{
-			"test": {
-				vmssName: {
-					Name: &vmssName,
-					Sku: &compute.Sku{
-						Capacity: &vmssCapacity,
-					},
-					VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
-						ProvisioningState: to.StringPtr(string(compute.ProvisioningStateUpdating)),
-					},
-				},
-			},
-		},
+	manager.azClient.virtualMachineScaleSetsClient = &clampingScaleSetsClient{
+		VirtualMachineScaleSetsClientMock: manager.VMSSClient().(*azuretesting.VirtualMachineScaleSetsClientMock),
+		clampedCapacity:                   4,
 	}
-	manager.azClient.virtualMachineScaleSetsClient = scaleSetClient
-	registered := manager.RegisterAsg(newTestScaleSet(manager, vmssName))
+	registered := manager.RegisterAsg(newTestScaleSet(manager, "test-asg"))
 	assert.True(t, registered)
-	manager.regenerateCache()
 
-	provider, err := BuildAzureCloudProvider(manager, nil)
+	scaleSet, ok := manager.GetAsgs()[0].(*ScaleSet)
+	assert.True(t, ok)
+
+	// Requesting +2 (3 -> 5) but Azure only grants capacity 4.
+	err := scaleSet.IncreaseSize(2)
 	assert.NoError(t, err)
 
-	// Scaling should continue even VMSS is under updating.
-	scaleSet, ok := provider.NodeGroups()[0].(*ScaleSet)
-	assert.True(t, ok)
-	err = scaleSet.IncreaseSize(1)
+	targetSize, err := scaleSet.TargetSize()
 	assert.NoError(t, err)
+	assert.Equal(t, 4, targetSize)
 }
 
 func TestBelongs(t *testing.T) {
@@ -138,9 +188,7 @@ func TestBelongs(t *testing.T) {
 
 	scaleSet, ok := provider.NodeGroups()[0].(*ScaleSet)
 	assert.True(t, ok)
-	// TODO: this should call manager.Refresh() once the fetchAutoASG
-	// logic is refactored out
-	provider.azureManager.regenerateCache()
+	assert.NoError(t, provider.azureManager.Refresh())
 
 	invalidNode := &apiv1.Node{
 		Spec: apiv1.NodeSpec{
@@ -161,44 +209,22 @@ func TestBelongs(t *testing.T) {
 }
 
 func TestDeleteNodes(t *testing.T) {
-	manager := newTestAzureManager(t)
-	vmssName := "test-asg"
-	var vmssCapacity int64 = 3
-	scaleSetClient := &VirtualMachineScaleSetsClientMock{
-		FakeStore: map[string]map[string]compute.VirtualMachineScaleSet{
-			"test": {
-				"test-asg": {
-					Name: &vmssName,
-					Sku: &compute.Sku{
-						Capacity: &vmssCapacity,
-					},
-				},
-			},
-		},
-	}
-	response := autorest.Response{
-		Response: &http.Response{
-			Status: "OK",
-		},
+	manager := azuretesting.GetTestCloud(t)
+
+	postDelete := compute.VirtualMachineScaleSet{
+		Name: to.StringPtr(azuretesting.TestVMSSName),
+		Sku:  &compute.Sku{Capacity: to.Int64Ptr(2)},
 	}
-	scaleSetClient.On("DeleteInstancesAsync", mock.Anything, "test-asg", mock.Anything, mock.Anything).Return(response, nil)
-	manager.azClient.virtualMachineScaleSetsClient = scaleSetClient
-	// TODO: this should call manager.Refresh() once the fetchAutoASG
-	// logic is refactored out
-	manager.regenerateCache()
-
-	resourceLimiter := cloudprovider.NewResourceLimiter(
-		map[string]int64{cloudprovider.ResourceNameCores: 1, cloudprovider.ResourceNameMemory: 10000000},
-		map[string]int64{cloudprovider.ResourceNameCores: 10, cloudprovider.ResourceNameMemory: 100000000})
-	provider, err := BuildAzureCloudProvider(manager, resourceLimiter)
+	scaleSetClient := manager.VMSSClient().(*azuretesting.VirtualMachineScaleSetsClientMock)
+	scaleSetClient.On("DeleteInstancesAsync", mock.Anything, azuretesting.TestResourceGroup, azuretesting.TestVMSSName, mock.Anything, mock.Anything).
+		Return(postDelete, nil)
+
+	provider, err := BuildAzureCloudProvider(manager, nil)
 	assert.NoError(t, err)
 
-	registered := manager.RegisterAsg(
-		newTestScaleSet(manager, "test-asg"))
+	registered := manager.RegisterAsg(newTestScaleSet(manager, azuretesting.TestVMSSName))
 	assert.True(t, registered)
-	// TODO: this should call manager.Refresh() once the fetchAutoASG
-	// logic is refactored out
-	manager.regenerateCache()
+	assert.NoError(t, manager.Refresh())
 
 	node := &apiv1.Node{
 		Spec: apiv1.NodeSpec{
@@ -216,7 +242,7 @@ func TestDeleteNodes(t *testing.T) {
 	err = scaleSet.DeleteNodes([]*apiv1.Node{node})
 	assert.NoError(t, err)
 
-	// Ensure the the cached size has been proactively decremented
+	// Ensure the cached size reflects the VMSS DeleteInstancesAsync returned
 	targetSize, err = scaleSet.TargetSize()
 	assert.NoError(t, err)
 	assert.Equal(t, 2, targetSize)
@@ -224,56 +250,55 @@ func TestDeleteNodes(t *testing.T) {
 	scaleSetClient.AssertNumberOfCalls(t, "DeleteInstancesAsync", 1)
 }
 
-func TestDeleteNoConflictRequest(t *testing.T) {
-	vmssName := "test-asg"
-	var vmssCapacity int64 = 3
+// TestDeleteNodesInvalidatesProvisioningState checks that DeleteNodes drops
+// the deleted instance's cached ProvisioningState instead of leaving it to
+// answer from a stale cache entry until the next ReadTypeForceRefresh.
+func TestDeleteNodesInvalidatesProvisioningState(t *testing.T) {
+	manager := azuretesting.GetTestCloud(t)
 
-	manager := newTestAzureManager(t)
-	vmsClient := &VirtualMachineScaleSetVMsClientMock{
-		FakeStore: map[string]map[string]compute.VirtualMachineScaleSetVM{
-			"test": {
-				"0": {
-					ID:         to.StringPtr(fakeVirtualMachineScaleSetVMID),
-					InstanceID: to.StringPtr("0"),
-					VirtualMachineScaleSetVMProperties: &compute.VirtualMachineScaleSetVMProperties{
-						VMID:              to.StringPtr("123E4567-E89B-12D3-A456-426655440000"),
-						ProvisioningState: to.StringPtr("Deleting"),
-					},
-				},
-			},
-		},
+	postDelete := compute.VirtualMachineScaleSet{
+		Name: to.StringPtr(azuretesting.TestVMSSName),
+		Sku:  &compute.Sku{Capacity: to.Int64Ptr(2)},
 	}
+	scaleSetClient := manager.VMSSClient().(*azuretesting.VirtualMachineScaleSetsClientMock)
+	scaleSetClient.On("DeleteInstancesAsync", mock.Anything, azuretesting.TestResourceGroup, azuretesting.TestVMSSName, mock.Anything, mock.Anything).
+		Return(postDelete, nil)
 
-	scaleSetClient := &VirtualMachineScaleSetsClientMock{
-		FakeStore: map[string]map[string]compute.VirtualMachineScaleSet{
-			"test": {
-				"test-asg": {
-					Name: &vmssName,
-					Sku: &compute.Sku{
-						Capacity: &vmssCapacity,
-					},
-				},
-			},
-		},
-	}
+	registered := manager.RegisterAsg(newTestScaleSet(manager, azuretesting.TestVMSSName))
+	assert.True(t, registered)
+	assert.NoError(t, manager.Refresh())
 
-	response := autorest.Response{
-		Response: &http.Response{
-			Status: "OK",
+	scaleSet, ok := manager.GetAsgs()[0].(*ScaleSet)
+	assert.True(t, ok)
+
+	node := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "azure://" + fakeVirtualMachineScaleSetVMID,
 		},
 	}
+	assert.NoError(t, scaleSet.DeleteNodes([]*apiv1.Node{node}))
 
-	scaleSetClient.On("DeleteInstancesAsync", mock.Anything, "test-asg", mock.Anything, mock.Anything).Return(response, nil)
-	manager.azClient.virtualMachineScaleSetsClient = scaleSetClient
-	manager.azClient.virtualMachineScaleSetVMsClient = vmsClient
+	// The instance is now gone from ARM; simulate that in the fake so a live
+	// fetch (rather than a stale cache hit) is observable as an error.
+	vmssVMsClient := manager.VMSSVMsClient().(*azuretesting.VirtualMachineScaleSetVMsClientMock)
+	delete(vmssVMsClient.FakeStore[azuretesting.TestResourceGroup][azuretesting.TestVMSSName], "0")
 
-	resourceLimiter := cloudprovider.NewResourceLimiter(
-		map[string]int64{cloudprovider.ResourceNameCores: 1, cloudprovider.ResourceNameMemory: 10000000},
-		map[string]int64{cloudprovider.ResourceNameCores: 10, cloudprovider.ResourceNameMemory: 100000000})
-	provider, err := BuildAzureCloudProvider(manager, resourceLimiter)
+	_, err := manager.getVMProvisioningState(azuretesting.TestVMSSName, "0", azcache.ReadTypeUnsafe)
+	assert.Error(t, err)
+}
+
+func TestDeleteNoConflictRequest(t *testing.T) {
+	manager := azuretesting.GetTestCloud(t)
+	azuretesting.SetVMProvisioningState(t, manager, azuretesting.TestVMSSName, "0", "Deleting")
+
+	scaleSetClient := manager.VMSSClient().(*azuretesting.VirtualMachineScaleSetsClientMock)
+	scaleSetClient.On("DeleteInstancesAsync", mock.Anything, azuretesting.TestResourceGroup, azuretesting.TestVMSSName, mock.Anything, mock.Anything).
+		Return(compute.VirtualMachineScaleSet{}, nil)
+
+	provider, err := BuildAzureCloudProvider(manager, nil)
 	assert.NoError(t, err)
 
-	registered := manager.RegisterAsg(newTestScaleSet(manager, "test-asg"))
+	registered := manager.RegisterAsg(newTestScaleSet(manager, azuretesting.TestVMSSName))
 	assert.True(t, registered)
 
 	node := &apiv1.Node{
@@ -286,6 +311,7 @@ func TestDeleteNoConflictRequest(t *testing.T) {
 	assert.True(t, ok)
 
 	err = scaleSet.DeleteNodes([]*apiv1.Node{node})
+	assert.NoError(t, err)
 	// ensure that DeleteInstancesAsync isn't called
 	scaleSetClient.AssertNumberOfCalls(t, "DeleteInstancesAsync", 0)
 }
@@ -313,9 +339,7 @@ func TestScaleSetNodes(t *testing.T) {
 	provider := newTestProvider(t)
 	registered := provider.azureManager.RegisterAsg(
 		newTestScaleSet(provider.azureManager, "test-asg"))
-	// TODO: this should call manager.Refresh() once the fetchAutoASG
-	// logic is refactored out
-	provider.azureManager.regenerateCache()
+	assert.NoError(t, provider.azureManager.Refresh())
 	assert.True(t, registered)
 	assert.Equal(t, len(provider.NodeGroups()), 1)
 
@@ -361,6 +385,192 @@ func TestTemplateNodeInfo(t *testing.T) {
 	assert.NotEmpty(t, nodeInfo.Pods())
 }
 
+// newTestFlexScaleSet wires up a manager registered with a single VMSS Flex
+// orchestration group ("flex-asg") with one member VM ("flex-vm-0"), and
+// refreshes the cache so the ScaleSet's orchestrationMode/flexVMs are populated.
+func newTestFlexScaleSet(t *testing.T) (*AzureManager, *ScaleSet, *azuretesting.VirtualMachinesClientMock) {
+	vmssName := "flex-asg"
+	vmssID := "/subscriptions/" + azuretesting.TestSubscriptionID + "/resourceGroups/" + azuretesting.TestResourceGroup +
+		"/providers/Microsoft.Compute/virtualMachineScaleSets/" + vmssName
+
+	manager := azuretesting.GetTestCloud(t)
+	scaleSet := azuretesting.RegisterFakeVMSS(t, manager, vmssName, 1, compute.Flexible)
+
+	vmsClient := &azuretesting.VirtualMachinesClientMock{
+		FakeStore: map[string]map[string]compute.VirtualMachine{
+			azuretesting.TestResourceGroup: {
+				"flex-vm-0": {
+					Name: to.StringPtr("flex-vm-0"),
+					ID:   to.StringPtr("/subscriptions/" + azuretesting.TestSubscriptionID + "/resourceGroups/" + azuretesting.TestResourceGroup + "/providers/Microsoft.Compute/virtualMachines/flex-vm-0"),
+					VirtualMachineProperties: &compute.VirtualMachineProperties{
+						VirtualMachineScaleSet: &compute.SubResource{ID: to.StringPtr(vmssID)},
+					},
+				},
+			},
+		},
+	}
+	manager.azClient.virtualMachinesClient = vmsClient
+	assert.NoError(t, manager.Refresh())
+
+	return manager, scaleSet, vmsClient
+}
+
+func TestBelongsVmssFlex(t *testing.T) {
+	_, scaleSet, _ := newTestFlexScaleSet(t)
+
+	invalidNode := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "azure:///subscriptions/subscription-id/resourceGroups/other/providers/Microsoft.Compute/virtualMachines/flex-vm-0",
+		},
+	}
+	_, err := scaleSet.Belongs(invalidNode)
+	assert.Error(t, err)
+
+	validNode := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "azure:///subscriptions/subscription-id/resourceGroups/test/providers/Microsoft.Compute/virtualMachines/flex-vm-0",
+		},
+	}
+	belongs, err := scaleSet.Belongs(validNode)
+	assert.NoError(t, err)
+	assert.True(t, belongs)
+}
+
+func TestDeleteNodesVmssFlex(t *testing.T) {
+	_, scaleSet, vmsClient := newTestFlexScaleSet(t)
+	vmsClient.On("Delete", mock.Anything, "test", "flex-vm-0").Return(nil)
+
+	targetSize, err := scaleSet.TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, targetSize)
+
+	node := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "azure:///subscriptions/subscription-id/resourceGroups/test/providers/Microsoft.Compute/virtualMachines/flex-vm-0",
+		},
+	}
+	err = scaleSet.DeleteNodes([]*apiv1.Node{node})
+	assert.NoError(t, err)
+
+	targetSize, err = scaleSet.TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, targetSize)
+
+	vmsClient.AssertNumberOfCalls(t, "Delete", 1)
+}
+
+// TestDeleteNodesVmssFlexValidatesAllBeforeDeleting checks that a node
+// failing Belongs aborts the whole call before any VM is deleted, so a bad
+// node later in the batch can't leave an earlier, valid one deleted with the
+// VMSS capacity never decremented to match.
+func TestDeleteNodesVmssFlexValidatesAllBeforeDeleting(t *testing.T) {
+	_, scaleSet, vmsClient := newTestFlexScaleSet(t)
+
+	validNode := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "azure:///subscriptions/subscription-id/resourceGroups/test/providers/Microsoft.Compute/virtualMachines/flex-vm-0",
+		},
+	}
+	invalidNode := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "azure:///subscriptions/subscription-id/resourceGroups/other/providers/Microsoft.Compute/virtualMachines/flex-vm-1",
+		},
+	}
+
+	err := scaleSet.DeleteNodes([]*apiv1.Node{validNode, invalidNode})
+	assert.Error(t, err)
+
+	vmsClient.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything, mock.Anything)
+	targetSize, err := scaleSet.TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, targetSize)
+}
+
+// TestDeleteNodesVmssFlexPreservesVMSSProperties guards against
+// deleteFlexNodes sending CreateOrUpdate a bare Sku-only body, which (being a
+// full-resource PUT on real ARM) would wipe every other field - here modeled
+// by Tags - out of the scale set.
+func TestDeleteNodesVmssFlexPreservesVMSSProperties(t *testing.T) {
+	manager, scaleSet, vmsClient := newTestFlexScaleSet(t)
+	vmsClient.On("Delete", mock.Anything, "test", "flex-vm-0").Return(nil)
+
+	scaleSetClient := manager.VMSSClient().(*azuretesting.VirtualMachineScaleSetsClientMock)
+	vmss := scaleSetClient.FakeStore[azuretesting.TestResourceGroup]["flex-asg"]
+	vmss.Tags = map[string]*string{"owner": to.StringPtr("team-b")}
+	scaleSetClient.FakeStore[azuretesting.TestResourceGroup]["flex-asg"] = vmss
+	assert.NoError(t, manager.Refresh())
+
+	node := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "azure:///subscriptions/subscription-id/resourceGroups/test/providers/Microsoft.Compute/virtualMachines/flex-vm-0",
+		},
+	}
+	assert.NoError(t, scaleSet.DeleteNodes([]*apiv1.Node{node}))
+
+	updated := scaleSetClient.FakeStore[azuretesting.TestResourceGroup]["flex-asg"]
+	assert.Equal(t, int64(0), *updated.Sku.Capacity)
+	assert.Equal(t, "team-b", *updated.Tags["owner"])
+	assert.Equal(t, compute.Flexible, updated.VirtualMachineScaleSetProperties.OrchestrationMode)
+}
+
+// TestDeleteNodesVmssFlexPartialFailureDecrementsProportionally checks that
+// when a Delete call fails partway through a multi-node batch, the VMSS
+// capacity is still decremented to match the VMs that were actually deleted
+// before the failure, rather than left untouched or decremented for the
+// whole batch.
+func TestDeleteNodesVmssFlexPartialFailureDecrementsProportionally(t *testing.T) {
+	vmssName := "flex-asg-2"
+	vmssID := "/subscriptions/" + azuretesting.TestSubscriptionID + "/resourceGroups/" + azuretesting.TestResourceGroup +
+		"/providers/Microsoft.Compute/virtualMachineScaleSets/" + vmssName
+
+	manager := azuretesting.GetTestCloud(t)
+	scaleSet := azuretesting.RegisterFakeVMSS(t, manager, vmssName, 2, compute.Flexible)
+
+	vmsClient := &azuretesting.VirtualMachinesClientMock{
+		FakeStore: map[string]map[string]compute.VirtualMachine{
+			azuretesting.TestResourceGroup: {
+				"flex-vm-0": {
+					Name: to.StringPtr("flex-vm-0"),
+					ID:   to.StringPtr("/subscriptions/" + azuretesting.TestSubscriptionID + "/resourceGroups/" + azuretesting.TestResourceGroup + "/providers/Microsoft.Compute/virtualMachines/flex-vm-0"),
+					VirtualMachineProperties: &compute.VirtualMachineProperties{
+						VirtualMachineScaleSet: &compute.SubResource{ID: to.StringPtr(vmssID)},
+					},
+				},
+				"flex-vm-1": {
+					Name: to.StringPtr("flex-vm-1"),
+					ID:   to.StringPtr("/subscriptions/" + azuretesting.TestSubscriptionID + "/resourceGroups/" + azuretesting.TestResourceGroup + "/providers/Microsoft.Compute/virtualMachines/flex-vm-1"),
+					VirtualMachineProperties: &compute.VirtualMachineProperties{
+						VirtualMachineScaleSet: &compute.SubResource{ID: to.StringPtr(vmssID)},
+					},
+				},
+			},
+		},
+	}
+	manager.azClient.virtualMachinesClient = vmsClient
+	assert.NoError(t, manager.Refresh())
+
+	vmsClient.On("Delete", mock.Anything, "test", "flex-vm-0").Return(nil)
+	vmsClient.On("Delete", mock.Anything, "test", "flex-vm-1").Return(fmt.Errorf("ARM throttled"))
+
+	node0 := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "azure:///subscriptions/subscription-id/resourceGroups/test/providers/Microsoft.Compute/virtualMachines/flex-vm-0",
+		},
+	}
+	node1 := &apiv1.Node{
+		Spec: apiv1.NodeSpec{
+			ProviderID: "azure:///subscriptions/subscription-id/resourceGroups/test/providers/Microsoft.Compute/virtualMachines/flex-vm-1",
+		},
+	}
+
+	err := scaleSet.DeleteNodes([]*apiv1.Node{node0, node1})
+	assert.Error(t, err)
+
+	targetSize, err := scaleSet.TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, targetSize)
+}
+
 func TestExtractAllocatableResourcesFromScaleSet(t *testing.T) {
 	tags := map[string]*string{
 		fmt.Sprintf("%s%s", nodeResourcesTagName, "cpu"):               to.StringPtr("100m"),
@@ -0,0 +1,168 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+
+	apiv1 "k8s.io/api/core/v1"
+
+	azcache "k8s.io/autoscaler/cluster-autoscaler/cloudprovider/azure/cache"
+)
+
+// ConditionType identifies a particular aspect of a ScaleSet's health,
+// modeled on CAPZ's AzureMachinePool scale set conditions.
+type ConditionType string
+
+const (
+	// ScaleSetDesiredReplicasCondition reports whether the VMSS has finished
+	// applying its desired Sku.Capacity.
+	ScaleSetDesiredReplicasCondition ConditionType = "ScaleSetDesiredReplicas"
+	// ScaleSetModelUpdatedCondition reports whether every instance in the
+	// scale set has picked up its latest model.
+	ScaleSetModelUpdatedCondition ConditionType = "ScaleSetModelUpdated"
+)
+
+// Condition reasons explaining why a ScaleSetDesiredReplicasCondition or
+// ScaleSetModelUpdatedCondition is False.
+const (
+	// ScaleSetScalingUp means the VMSS is rolling out an increase of Sku.Capacity.
+	ScaleSetScalingUp = "ScalingUp"
+	// ScaleSetScalingDown means the VMSS is rolling out a decrease of Sku.Capacity.
+	ScaleSetScalingDown = "ScalingDown"
+	// ScaleSetProvisionFailed means the VMSS's last operation failed.
+	ScaleSetProvisionFailed = "ProvisionFailed"
+	// ScaleSetDeleting means the VMSS itself is being deleted.
+	ScaleSetDeleting = "Deleting"
+	// ScaleSetModelOutOfDate means at least one instance has not picked up
+	// the VMSS's latest model.
+	ScaleSetModelOutOfDate = "ModelOutOfDate"
+)
+
+// Condition is a single, structured piece of ScaleSet status.
+type Condition struct {
+	Type   ConditionType
+	Status apiv1.ConditionStatus
+	Reason string
+}
+
+// NodeGroupStatus is implemented by node groups that can report structured
+// conditions about why a scale operation might be stalled, for callers that
+// want to log or record more than TargetSize/MaxSize/MinSize convey.
+type NodeGroupStatus interface {
+	Conditions() ([]Condition, error)
+}
+
+// Conditions reports the ScaleSetDesiredReplicasCondition and
+// ScaleSetModelUpdatedCondition for the scale set, so callers can tell why a
+// scale operation might be stalled (e.g. the VMSS is stuck Updating).
+func (scaleSet *ScaleSet) Conditions() ([]Condition, error) {
+	vmss, err := scaleSet.manager.getVMSS(scaleSet.Name, azcache.ReadTypeUnsafe)
+	if err != nil {
+		return nil, err
+	}
+
+	replicas, err := scaleSet.desiredReplicasCondition(vmss)
+	if err != nil {
+		return nil, err
+	}
+
+	modelUpdated, err := scaleSet.modelUpdatedCondition()
+	if err != nil {
+		return nil, err
+	}
+
+	return []Condition{replicas, modelUpdated}, nil
+}
+
+// desiredReplicasCondition derives ScaleSetDesiredReplicasCondition from the
+// VMSS's cached ProvisioningState.
+func (scaleSet *ScaleSet) desiredReplicasCondition(vmss compute.VirtualMachineScaleSet) (Condition, error) {
+	var state compute.ProvisioningState
+	if vmss.VirtualMachineScaleSetProperties != nil && vmss.VirtualMachineScaleSetProperties.ProvisioningState != nil {
+		state = compute.ProvisioningState(*vmss.VirtualMachineScaleSetProperties.ProvisioningState)
+	}
+
+	switch state {
+	case compute.ProvisioningStateDeleting:
+		return Condition{Type: ScaleSetDesiredReplicasCondition, Status: apiv1.ConditionFalse, Reason: ScaleSetDeleting}, nil
+	case compute.ProvisioningStateFailed:
+		return Condition{Type: ScaleSetDesiredReplicasCondition, Status: apiv1.ConditionFalse, Reason: ScaleSetProvisionFailed}, nil
+	case compute.ProvisioningStateUpdating:
+		reason, err := scaleSet.scalingDirection(vmss)
+		if err != nil {
+			return Condition{}, err
+		}
+		return Condition{Type: ScaleSetDesiredReplicasCondition, Status: apiv1.ConditionFalse, Reason: reason}, nil
+	default:
+		return Condition{Type: ScaleSetDesiredReplicasCondition, Status: apiv1.ConditionTrue}, nil
+	}
+}
+
+// scalingDirection compares the VMSS's desired capacity to its current
+// instance count to tell whether an Updating VMSS is scaling up or down.
+func (scaleSet *ScaleSet) scalingDirection(vmss compute.VirtualMachineScaleSet) (string, error) {
+	var desired int64
+	if vmss.Sku != nil && vmss.Sku.Capacity != nil {
+		desired = *vmss.Sku.Capacity
+	}
+
+	var current int64
+	if scaleSet.orchestrationMode == compute.Flexible {
+		vms, err := scaleSet.manager.getVmssFlexVMs(scaleSet.Name, azcache.ReadTypeUnsafe)
+		if err != nil {
+			return "", err
+		}
+		current = int64(len(vms))
+	} else {
+		vms, err := scaleSet.manager.getVMSSVMs(scaleSet.Name, azcache.ReadTypeUnsafe)
+		if err != nil {
+			return "", err
+		}
+		current = int64(len(vms))
+	}
+
+	if current > desired {
+		return ScaleSetScalingDown, nil
+	}
+	return ScaleSetScalingUp, nil
+}
+
+// modelUpdatedCondition reports ScaleSetModelOutOfDate if any instance has
+// not yet picked up the VMSS's latest model. VMSS Flex members are standalone
+// VMs with no "model" to fall behind on, so a Flex scale set is always
+// reported as up to date.
+func (scaleSet *ScaleSet) modelUpdatedCondition() (Condition, error) {
+	if scaleSet.orchestrationMode == compute.Flexible {
+		return Condition{Type: ScaleSetModelUpdatedCondition, Status: apiv1.ConditionTrue}, nil
+	}
+
+	vms, err := scaleSet.manager.getVMSSVMs(scaleSet.Name, azcache.ReadTypeUnsafe)
+	if err != nil {
+		return Condition{}, err
+	}
+
+	for _, vm := range vms {
+		if vm.VirtualMachineScaleSetVMProperties == nil || vm.VirtualMachineScaleSetVMProperties.LatestModelApplied == nil {
+			continue
+		}
+		if !*vm.VirtualMachineScaleSetVMProperties.LatestModelApplied {
+			return Condition{Type: ScaleSetModelUpdatedCondition, Status: apiv1.ConditionFalse, Reason: ScaleSetModelOutOfDate}, nil
+		}
+	}
+	return Condition{Type: ScaleSetModelUpdatedCondition, Status: apiv1.ConditionTrue}, nil
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/stretchr/testify/assert"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/azure/azuretesting"
+)
+
+// newTestConditionScaleSet wires up a manager registered with a single VMSS
+// in provisioningState, with a capacity and instance count set independently
+// so TestConditions can exercise the up/down scaling direction.
+func newTestConditionScaleSet(t *testing.T, provisioningState string, capacity int64, instanceCount int) *ScaleSet {
+	vmssName := "test-asg"
+
+	manager := newTestAzureManager(t)
+	manager.azClient.virtualMachineScaleSetsClient = &azuretesting.VirtualMachineScaleSetsClientMock{
+		FakeStore: map[string]map[string]compute.VirtualMachineScaleSet{
+			"test": {
+				vmssName: {
+					Name: &vmssName,
+					Sku:  &compute.Sku{Capacity: &capacity},
+					VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
+						ProvisioningState: to.StringPtr(provisioningState),
+					},
+				},
+			},
+		},
+	}
+
+	vms := map[string]compute.VirtualMachineScaleSetVM{}
+	for i := 0; i < instanceCount; i++ {
+		instanceID := fmt.Sprintf("%d", i)
+		vms[instanceID] = compute.VirtualMachineScaleSetVM{
+			InstanceID: to.StringPtr(instanceID),
+			VirtualMachineScaleSetVMProperties: &compute.VirtualMachineScaleSetVMProperties{
+				ProvisioningState:  to.StringPtr("Succeeded"),
+				LatestModelApplied: to.BoolPtr(true),
+			},
+		}
+	}
+	manager.azClient.virtualMachineScaleSetVMsClient = &azuretesting.VirtualMachineScaleSetVMsClientMock{
+		FakeStore: map[string]map[string]map[string]compute.VirtualMachineScaleSetVM{"test": {vmssName: vms}},
+	}
+
+	registered := manager.RegisterAsg(newTestScaleSet(manager, vmssName))
+	assert.True(t, registered)
+	assert.NoError(t, manager.Refresh())
+
+	scaleSet, ok := manager.GetAsgs()[0].(*ScaleSet)
+	assert.True(t, ok)
+	return scaleSet
+}
+
+func TestConditionsSucceeded(t *testing.T) {
+	scaleSet := newTestConditionScaleSet(t, "Succeeded", 3, 3)
+
+	conditions, err := scaleSet.Conditions()
+	assert.NoError(t, err)
+	assert.Equal(t, Condition{Type: ScaleSetDesiredReplicasCondition, Status: apiv1.ConditionTrue}, conditions[0])
+	assert.Equal(t, Condition{Type: ScaleSetModelUpdatedCondition, Status: apiv1.ConditionTrue}, conditions[1])
+}
+
+func TestConditionsScalingUp(t *testing.T) {
+	scaleSet := newTestConditionScaleSet(t, string(compute.ProvisioningStateUpdating), 5, 3)
+
+	conditions, err := scaleSet.Conditions()
+	assert.NoError(t, err)
+	assert.Equal(t, Condition{Type: ScaleSetDesiredReplicasCondition, Status: apiv1.ConditionFalse, Reason: ScaleSetScalingUp}, conditions[0])
+}
+
+func TestConditionsScalingDown(t *testing.T) {
+	scaleSet := newTestConditionScaleSet(t, string(compute.ProvisioningStateUpdating), 1, 3)
+
+	conditions, err := scaleSet.Conditions()
+	assert.NoError(t, err)
+	assert.Equal(t, Condition{Type: ScaleSetDesiredReplicasCondition, Status: apiv1.ConditionFalse, Reason: ScaleSetScalingDown}, conditions[0])
+}
+
+func TestConditionsProvisionFailed(t *testing.T) {
+	scaleSet := newTestConditionScaleSet(t, string(compute.ProvisioningStateFailed), 3, 3)
+
+	conditions, err := scaleSet.Conditions()
+	assert.NoError(t, err)
+	assert.Equal(t, Condition{Type: ScaleSetDesiredReplicasCondition, Status: apiv1.ConditionFalse, Reason: ScaleSetProvisionFailed}, conditions[0])
+}
+
+func TestConditionsDeleting(t *testing.T) {
+	scaleSet := newTestConditionScaleSet(t, string(compute.ProvisioningStateDeleting), 3, 3)
+
+	conditions, err := scaleSet.Conditions()
+	assert.NoError(t, err)
+	assert.Equal(t, Condition{Type: ScaleSetDesiredReplicasCondition, Status: apiv1.ConditionFalse, Reason: ScaleSetDeleting}, conditions[0])
+}
+
+func TestConditionsModelOutOfDate(t *testing.T) {
+	scaleSet := newTestConditionScaleSet(t, "Succeeded", 1, 1)
+
+	vms := managerVMsFakeStore(scaleSet)
+	vm := vms["0"]
+	vm.VirtualMachineScaleSetVMProperties.LatestModelApplied = to.BoolPtr(false)
+	vms["0"] = vm
+	assert.NoError(t, scaleSet.manager.Refresh())
+
+	conditions, err := scaleSet.Conditions()
+	assert.NoError(t, err)
+	assert.Equal(t, Condition{Type: ScaleSetModelUpdatedCondition, Status: apiv1.ConditionFalse, Reason: ScaleSetModelOutOfDate}, conditions[1])
+}
+
+// managerVMsFakeStore returns the FakeStore backing scaleSet's manager, so
+// tests can mutate an instance's properties between cache refreshes.
+func managerVMsFakeStore(scaleSet *ScaleSet) map[string]compute.VirtualMachineScaleSetVM {
+	mock := scaleSet.manager.azClient.virtualMachineScaleSetVMsClient.(*azuretesting.VirtualMachineScaleSetVMsClientMock)
+	return mock.FakeStore["test"][scaleSet.Name]
+}
+
+// newTestConditionFlexScaleSet wires up a manager registered with a single
+// VMSS Flex orchestration group in provisioningState, with a capacity and
+// member count set independently so TestConditionsVmssFlex* can exercise the
+// up/down scaling direction on the Flex path.
+func newTestConditionFlexScaleSet(t *testing.T, provisioningState string, capacity int64, memberCount int) *ScaleSet {
+	vmssName := "flex-asg"
+	vmssID := "/subscriptions/" + azuretesting.TestSubscriptionID + "/resourceGroups/" + azuretesting.TestResourceGroup +
+		"/providers/Microsoft.Compute/virtualMachineScaleSets/" + vmssName
+
+	manager := azuretesting.GetTestCloud(t)
+	scaleSet := azuretesting.RegisterFakeVMSS(t, manager, vmssName, capacity, compute.Flexible)
+
+	scaleSetClient := manager.VMSSClient().(*azuretesting.VirtualMachineScaleSetsClientMock)
+	vmss := scaleSetClient.FakeStore[azuretesting.TestResourceGroup][vmssName]
+	vmss.VirtualMachineScaleSetProperties.ProvisioningState = to.StringPtr(provisioningState)
+	scaleSetClient.FakeStore[azuretesting.TestResourceGroup][vmssName] = vmss
+
+	members := map[string]compute.VirtualMachine{}
+	for i := 0; i < memberCount; i++ {
+		name := fmt.Sprintf("flex-vm-%d", i)
+		members[name] = compute.VirtualMachine{
+			Name: to.StringPtr(name),
+			ID:   to.StringPtr("/subscriptions/" + azuretesting.TestSubscriptionID + "/resourceGroups/" + azuretesting.TestResourceGroup + "/providers/Microsoft.Compute/virtualMachines/" + name),
+			VirtualMachineProperties: &compute.VirtualMachineProperties{
+				VirtualMachineScaleSet: &compute.SubResource{ID: to.StringPtr(vmssID)},
+			},
+		}
+	}
+	manager.azClient.virtualMachinesClient = &azuretesting.VirtualMachinesClientMock{
+		FakeStore: map[string]map[string]compute.VirtualMachine{azuretesting.TestResourceGroup: members},
+	}
+	assert.NoError(t, manager.Refresh())
+
+	return scaleSet
+}
+
+func TestConditionsVmssFlexScalingUp(t *testing.T) {
+	scaleSet := newTestConditionFlexScaleSet(t, string(compute.ProvisioningStateUpdating), 3, 1)
+
+	conditions, err := scaleSet.Conditions()
+	assert.NoError(t, err)
+	assert.Equal(t, Condition{Type: ScaleSetDesiredReplicasCondition, Status: apiv1.ConditionFalse, Reason: ScaleSetScalingUp}, conditions[0])
+	assert.Equal(t, Condition{Type: ScaleSetModelUpdatedCondition, Status: apiv1.ConditionTrue}, conditions[1])
+}
+
+func TestConditionsVmssFlexScalingDown(t *testing.T) {
+	scaleSet := newTestConditionFlexScaleSet(t, string(compute.ProvisioningStateUpdating), 1, 3)
+
+	conditions, err := scaleSet.Conditions()
+	assert.NoError(t, err)
+	assert.Equal(t, Condition{Type: ScaleSetDesiredReplicasCondition, Status: apiv1.ConditionFalse, Reason: ScaleSetScalingDown}, conditions[0])
+}
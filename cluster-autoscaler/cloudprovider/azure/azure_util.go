@@ -0,0 +1,108 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// nodeResourcesTagName is the prefix of the tags used to carry node
+	// allocatable overrides (e.g. "k8s.io-cluster-autoscaler-node-template/resources/cpu").
+	nodeResourcesTagName = "k8s.io-cluster-autoscaler-node-template/resources/"
+
+	// defaultVmssSizeRefreshPeriod is the sizeRefreshPeriod NewScaleSet gives
+	// a ScaleSet. TargetSize does not consult it: it reads the cached VMSS
+	// capacity with ReadTypeUnsafe and never triggers a refresh itself.
+	defaultVmssSizeRefreshPeriod = 15 * time.Second
+)
+
+// vmssInstanceIDRegexp matches the instanceID segment of a Uniform-mode VMSS
+// provider ID, e.g. ".../virtualMachineScaleSets/agentpool1/virtualMachines/3".
+var vmssInstanceIDRegexp = regexp.MustCompile(`(?i)/subscriptions/.+/resourcegroups/(.+)/providers/microsoft.compute/virtualmachinescalesets/(.+)/virtualmachines/([^/]+)$`)
+
+// vmInstanceIDRegexp matches the provider ID of a Flex member VM, which is an
+// individual virtualMachines resource rather than a VMSS-relative index, e.g.
+// ".../virtualMachines/flex-agentpool1-vm-0".
+var vmInstanceIDRegexp = regexp.MustCompile(`(?i)/subscriptions/.+/resourcegroups/(.+)/providers/microsoft.compute/virtualmachines/([^/]+)$`)
+
+// resourceID describes the pieces of an Azure compute resource ID that
+// Belongs needs to match a node's providerID against a ScaleSet.
+type resourceID struct {
+	resourceGroup string
+	vmssName      string
+	instanceID    string
+}
+
+// parseUniformProviderID parses the providerID of a node backed by a VMSS
+// Uniform instance, returning an error if it does not match the expected shape.
+func parseUniformProviderID(providerID string) (resourceID, error) {
+	matches := vmssInstanceIDRegexp.FindStringSubmatch(strings.TrimPrefix(providerID, "azure://"))
+	if len(matches) != 4 {
+		return resourceID{}, fmt.Errorf("azure: can not parse VMSS providerID %q", providerID)
+	}
+	return resourceID{
+		resourceGroup: matches[1],
+		vmssName:      matches[2],
+		instanceID:    matches[3],
+	}, nil
+}
+
+// parseFlexProviderID parses the providerID of a node backed by a standalone
+// VM that is a member of a VMSS Flex orchestration group.
+func parseFlexProviderID(providerID string) (resourceID, error) {
+	matches := vmInstanceIDRegexp.FindStringSubmatch(strings.TrimPrefix(providerID, "azure://"))
+	if len(matches) != 3 {
+		return resourceID{}, fmt.Errorf("azure: can not parse VM providerID %q", providerID)
+	}
+	return resourceID{
+		resourceGroup: matches[1],
+		instanceID:    matches[2],
+	}, nil
+}
+
+// extractAllocatableResourcesFromScaleSet extracts the allocatable resources
+// specified through the VMSS tags (nodeResourcesTagName prefixed) and returns
+// them as a map from resource name (the tag name after the prefix) to
+// *resource.Quantity. Tags with a nil or unparsable value are skipped.
+func extractAllocatableResourcesFromScaleSet(tags map[string]*string) map[string]*resource.Quantity {
+	resources := make(map[string]*resource.Quantity)
+
+	for tagName, tagValue := range tags {
+		if !strings.HasPrefix(tagName, nodeResourcesTagName) {
+			continue
+		}
+
+		resourceName := strings.Split(tagName, nodeResourcesTagName)[1]
+		if tagValue == nil {
+			continue
+		}
+
+		quantity, err := resource.ParseQuantity(*tagValue)
+		if err != nil {
+			continue
+		}
+		resources[resourceName] = &quantity
+	}
+
+	return resources
+}
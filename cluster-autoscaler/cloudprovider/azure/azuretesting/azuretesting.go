@@ -0,0 +1,255 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package azuretesting provides an in-memory Azure fake cloud - a fully wired
+// *azure.AzureManager backed by mock ARM clients - so tests outside the azure package
+// (and future subsystems, e.g. a VMSS Flex path or ARM template expander) can describe
+// the scenario they care about instead of rebuilding the manager/mocks/provider plumbing
+// inline, mirroring how upstream cloud-provider-azure exports its fake cloud for
+// cross-package testing.
+package azuretesting
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/azure"
+)
+
+const (
+	// TestSubscriptionID is the subscription ID GetTestCloud wires the fake manager with.
+	TestSubscriptionID = "subscription-id"
+	// TestResourceGroup is the resource group GetTestCloud wires the fake manager with.
+	TestResourceGroup = "test"
+	// TestVMSSName is the name of the VMSS GetTestCloud prepopulates.
+	TestVMSSName = "test-asg"
+)
+
+// FakeVMProviderID is the providerID of the single fake instance ("0") of the
+// TestVMSSName VMSS that GetTestCloud seeds its fake clients' stores with. The
+// manager's own cache starts empty and fills on first read.
+const FakeVMProviderID = "/subscriptions/" + TestSubscriptionID + "/resourceGroups/" + TestResourceGroup +
+	"/providers/Microsoft.Compute/virtualMachineScaleSets/" + TestVMSSName + "/virtualMachines/0"
+
+// GetTestCloud returns an *azure.AzureManager wired to in-memory mock clients and
+// pre-populated with a single TestVMSSName VMSS (capacity 3) and its one instance, so
+// most tests can exercise ScaleSet methods right away. Use RegisterFakeVMSS to add more
+// VMSS scenarios and SetVMProvisioningState to drive instance-level state.
+func GetTestCloud(t *testing.T) *azure.AzureManager {
+	var vmssCapacity int64 = 3
+
+	scaleSetClient := &VirtualMachineScaleSetsClientMock{
+		FakeStore: map[string]map[string]compute.VirtualMachineScaleSet{
+			TestResourceGroup: {
+				TestVMSSName: {
+					Name: to.StringPtr(TestVMSSName),
+					Sku:  &compute.Sku{Capacity: &vmssCapacity},
+				},
+			},
+		},
+	}
+	vmssVMsClient := &VirtualMachineScaleSetVMsClientMock{
+		FakeStore: map[string]map[string]map[string]compute.VirtualMachineScaleSetVM{
+			TestResourceGroup: {
+				TestVMSSName: {
+					"0": {
+						ID:         to.StringPtr(FakeVMProviderID),
+						InstanceID: to.StringPtr("0"),
+						VirtualMachineScaleSetVMProperties: &compute.VirtualMachineScaleSetVMProperties{
+							ProvisioningState: to.StringPtr("Succeeded"),
+						},
+					},
+				},
+			},
+		},
+	}
+	vmsClient := &VirtualMachinesClientMock{
+		FakeStore: map[string]map[string]compute.VirtualMachine{TestResourceGroup: {}},
+	}
+
+	return azure.NewManagerForTesting(
+		&azure.Config{SubscriptionID: TestSubscriptionID, ResourceGroup: TestResourceGroup},
+		scaleSetClient, vmssVMsClient, vmsClient)
+}
+
+// RegisterFakeVMSS adds a VMSS named name (with the given capacity and orchestration
+// mode) to the fake backing manager, registers a matching ScaleSet node group with it,
+// and refreshes the manager's cache so the ScaleSet is immediately usable.
+func RegisterFakeVMSS(t *testing.T, manager *azure.AzureManager, name string, capacity int64, mode compute.OrchestrationMode) *azure.ScaleSet {
+	scaleSetClient := manager.VMSSClient().(*VirtualMachineScaleSetsClientMock)
+
+	scaleSetClient.mutex.Lock()
+	if scaleSetClient.FakeStore[TestResourceGroup] == nil {
+		scaleSetClient.FakeStore[TestResourceGroup] = map[string]compute.VirtualMachineScaleSet{}
+	}
+	scaleSetClient.FakeStore[TestResourceGroup][name] = compute.VirtualMachineScaleSet{
+		Name: to.StringPtr(name),
+		Sku:  &compute.Sku{Capacity: &capacity},
+		VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
+			OrchestrationMode: mode,
+		},
+	}
+	scaleSetClient.mutex.Unlock()
+
+	scaleSet := azure.NewScaleSet(manager, name, 1, 100)
+	assert.True(t, manager.RegisterAsg(scaleSet))
+	assert.NoError(t, manager.Refresh())
+	return scaleSet
+}
+
+// SetVMProvisioningState sets the cached ProvisioningState of instanceID in vmssName's
+// fake VM store, for tests exercising e.g. the "delete already in flight" path.
+func SetVMProvisioningState(t *testing.T, manager *azure.AzureManager, vmssName, instanceID, state string) {
+	vmssVMsClient := manager.VMSSVMsClient().(*VirtualMachineScaleSetVMsClientMock)
+
+	vmssVMsClient.mutex.Lock()
+	defer vmssVMsClient.mutex.Unlock()
+
+	vm := vmssVMsClient.FakeStore[TestResourceGroup][vmssName][instanceID]
+	if vm.VirtualMachineScaleSetVMProperties == nil {
+		vm.VirtualMachineScaleSetVMProperties = &compute.VirtualMachineScaleSetVMProperties{}
+	}
+	vm.VirtualMachineScaleSetVMProperties.ProvisioningState = to.StringPtr(state)
+	vmssVMsClient.FakeStore[TestResourceGroup][vmssName][instanceID] = vm
+}
+
+// VirtualMachineScaleSetsClientMock is a fake azure.VirtualMachineScaleSetsClient backed
+// by an in-memory FakeStore, keyed by resource group then VMSS name.
+// Get/List/CreateOrUpdate read and write the FakeStore directly; DeleteInstancesAsync goes
+// through testify so tests can assert on it and stub its returned post-delete VMSS.
+type VirtualMachineScaleSetsClientMock struct {
+	mock.Mock
+
+	mutex     sync.Mutex
+	FakeStore map[string]map[string]compute.VirtualMachineScaleSet
+}
+
+// Get returns the fake VMSS, or an error if it isn't in the FakeStore.
+func (m *VirtualMachineScaleSetsClientMock) Get(ctx context.Context, resourceGroupName string, vmScaleSetName string) (compute.VirtualMachineScaleSet, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if rg, ok := m.FakeStore[resourceGroupName]; ok {
+		if vmss, ok := rg[vmScaleSetName]; ok {
+			return vmss, nil
+		}
+	}
+	return compute.VirtualMachineScaleSet{}, fmt.Errorf("vmss %s not found in resource group %s", vmScaleSetName, resourceGroupName)
+}
+
+// List returns every fake VMSS in the given resource group.
+func (m *VirtualMachineScaleSetsClientMock) List(ctx context.Context, resourceGroupName string) ([]compute.VirtualMachineScaleSet, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var result []compute.VirtualMachineScaleSet
+	for _, vmss := range m.FakeStore[resourceGroupName] {
+		result = append(result, vmss)
+	}
+	return result, nil
+}
+
+// CreateOrUpdate writes parameters into the FakeStore and returns it back, mimicking
+// ARM persisting (and potentially clamping) the requested VMSS state.
+func (m *VirtualMachineScaleSetsClientMock) CreateOrUpdate(ctx context.Context, resourceGroupName string, vmScaleSetName string, parameters compute.VirtualMachineScaleSet) (compute.VirtualMachineScaleSet, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.FakeStore[resourceGroupName]; !ok {
+		m.FakeStore[resourceGroupName] = map[string]compute.VirtualMachineScaleSet{}
+	}
+	m.FakeStore[resourceGroupName][vmScaleSetName] = parameters
+	return parameters, nil
+}
+
+// DeleteInstancesAsync is stubbed per-test via mock.On so call counts can be asserted
+// and so tests can control the post-delete VMSS it returns.
+func (m *VirtualMachineScaleSetsClientMock) DeleteInstancesAsync(ctx context.Context, resourceGroupName string, vmScaleSetName string, vmInstanceIDs compute.VirtualMachineScaleSetVMInstanceRequiredIDs, forceDeletion *bool) (compute.VirtualMachineScaleSet, error) {
+	args := m.Called(ctx, resourceGroupName, vmScaleSetName, vmInstanceIDs, forceDeletion)
+	return args.Get(0).(compute.VirtualMachineScaleSet), args.Error(1)
+}
+
+// VirtualMachineScaleSetVMsClientMock is a fake azure.VirtualMachineScaleSetVMsClient
+// backed by an in-memory FakeStore, keyed by resource group, then VMSS name, then
+// instanceID, so List correctly scopes to the requested VMSS even when multiple
+// Uniform-mode scale sets share a resource group.
+type VirtualMachineScaleSetVMsClientMock struct {
+	mock.Mock
+
+	mutex     sync.Mutex
+	FakeStore map[string]map[string]map[string]compute.VirtualMachineScaleSetVM
+}
+
+// Get returns the fake VM instance, or an error if it isn't in the FakeStore.
+func (m *VirtualMachineScaleSetVMsClientMock) Get(ctx context.Context, resourceGroupName string, vmScaleSetName string, instanceID string) (compute.VirtualMachineScaleSetVM, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if vmss, ok := m.FakeStore[resourceGroupName]; ok {
+		if vm, ok := vmss[vmScaleSetName][instanceID]; ok {
+			return vm, nil
+		}
+	}
+	return compute.VirtualMachineScaleSetVM{}, fmt.Errorf("instance %s not found in scale set %s in resource group %s", instanceID, vmScaleSetName, resourceGroupName)
+}
+
+// List returns every fake VM instance belonging to the given VMSS.
+func (m *VirtualMachineScaleSetVMsClientMock) List(ctx context.Context, resourceGroupName string, vmScaleSetName string) ([]compute.VirtualMachineScaleSetVM, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var result []compute.VirtualMachineScaleSetVM
+	for _, vm := range m.FakeStore[resourceGroupName][vmScaleSetName] {
+		result = append(result, vm)
+	}
+	return result, nil
+}
+
+// VirtualMachinesClientMock is a fake azure.VirtualMachinesClient, used for VMSS Flex
+// orchestration groups whose members are standalone compute.VirtualMachine resources
+// rather than VMSS instance-view entries. List is backed directly by the FakeStore;
+// Delete is stubbed per-test via mock.On so call counts can be asserted.
+type VirtualMachinesClientMock struct {
+	mock.Mock
+
+	mutex     sync.Mutex
+	FakeStore map[string]map[string]compute.VirtualMachine
+}
+
+// List returns every fake VM in the given resource group.
+func (m *VirtualMachinesClientMock) List(ctx context.Context, resourceGroupName string) ([]compute.VirtualMachine, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var result []compute.VirtualMachine
+	for _, vm := range m.FakeStore[resourceGroupName] {
+		result = append(result, vm)
+	}
+	return result, nil
+}
+
+// Delete is stubbed per-test via mock.On so call counts can be asserted.
+func (m *VirtualMachinesClientMock) Delete(ctx context.Context, resourceGroupName string, vmName string) error {
+	args := m.Called(ctx, resourceGroupName, vmName)
+	return args.Error(0)
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cache provides a generic, TTL-based cache with explicit read modes,
+// shared by the pieces of the Azure provider (VMSS descriptions, VMSS/Flex
+// instance lists, per-VM provisioning states) that previously each kept their
+// own ad-hoc "regenerate on demand" map.
+package cache
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// GetFunc fetches the up to date value for key from the backing store (ARM).
+type GetFunc func(key string) (interface{}, error)
+
+// ReadType controls how Get behaves with respect to the cache's freshness.
+type ReadType int
+
+const (
+	// ReadTypeDefault returns the cached value if it is still within the
+	// TTL, otherwise fetches a fresh value.
+	ReadTypeDefault ReadType = iota
+	// ReadTypeUnsafe returns whatever is currently cached without checking
+	// freshness, only fetching if the key has never been populated. Meant
+	// for hot paths (e.g. TargetSize/Belongs) that would rather read a
+	// slightly stale value than pay for (and serialize on) a live fetch.
+	ReadTypeUnsafe
+	// ReadTypeForceRefresh discards any cached value and always fetches a
+	// fresh one. Used where a stale value is not acceptable (e.g.
+	// regenerateCache, and DeleteNodes' check of an instance's
+	// ProvisioningState before deleting it).
+	ReadTypeForceRefresh
+)
+
+// entry is a single cached value plus the bookkeeping needed to decide
+// whether it is still fresh. fetchMutex serializes concurrent live fetches of
+// the same key without blocking unrelated keys; dataMutex guards the cached
+// value itself and is only ever held briefly, so a ReadTypeUnsafe read never
+// blocks on an in-flight fetch held via fetchMutex.
+type entry struct {
+	fetchMutex sync.Mutex
+	dataMutex  sync.RWMutex
+	data       interface{}
+	populated  bool
+	lastUpdate time.Time
+}
+
+// TimedCache is a key/value cache with a single TTL and a getter used to
+// populate (or repopulate) any key on demand.
+type TimedCache struct {
+	ttl    time.Duration
+	getter GetFunc
+
+	storeMutex sync.Mutex
+	store      map[string]*entry
+}
+
+// NewTimedCache creates a TimedCache with the given TTL and getter.
+func NewTimedCache(ttl time.Duration, getter GetFunc) *TimedCache {
+	return &TimedCache{
+		ttl:    ttl,
+		getter: getter,
+		store:  make(map[string]*entry),
+	}
+}
+
+func (c *TimedCache) entryFor(key string) *entry {
+	c.storeMutex.Lock()
+	defer c.storeMutex.Unlock()
+
+	e, ok := c.store[key]
+	if !ok {
+		e = &entry{}
+		c.store[key] = e
+	}
+	return e
+}
+
+// Get returns the value for key, honoring the given ReadType.
+func (c *TimedCache) Get(key string, readType ReadType) (interface{}, error) {
+	e := c.entryFor(key)
+
+	if readType != ReadTypeForceRefresh {
+		if data, fresh, ok := e.readFresh(readType, c.ttl); ok {
+			if fresh {
+				return data, nil
+			}
+		}
+	}
+
+	// Either the entry needs a live fetch (unpopulated, stale, or a forced
+	// refresh) or the fast path above didn't apply. fetchMutex serializes
+	// concurrent fetches of this key only, so a ReadTypeUnsafe reader on
+	// another goroutine never blocks behind it.
+	e.fetchMutex.Lock()
+	defer e.fetchMutex.Unlock()
+
+	// Re-check now that we hold fetchMutex: another goroutine may have just
+	// refreshed this key while we were waiting for the lock.
+	if readType != ReadTypeForceRefresh {
+		if data, fresh, ok := e.readFresh(readType, c.ttl); ok && fresh {
+			return data, nil
+		}
+	}
+
+	data, err := c.getter(key)
+	if err != nil {
+		return nil, err
+	}
+
+	e.dataMutex.Lock()
+	e.data = data
+	e.populated = true
+	e.lastUpdate = time.Now()
+	e.dataMutex.Unlock()
+	return data, nil
+}
+
+// readFresh returns the currently cached value for the entry, along with
+// whether it is populated (ok) and, if so, whether it satisfies readType
+// without a live fetch (fresh). It never blocks on a concurrent fetch.
+func (e *entry) readFresh(readType ReadType, ttl time.Duration) (data interface{}, fresh bool, ok bool) {
+	e.dataMutex.RLock()
+	defer e.dataMutex.RUnlock()
+
+	if !e.populated {
+		return nil, false, false
+	}
+	if readType == ReadTypeUnsafe || time.Since(e.lastUpdate) < ttl {
+		return e.data, true, true
+	}
+	return e.data, false, true
+}
+
+// GetWithDeepCopy behaves like Get but returns a deep copy of the cached
+// value, for callers that may mutate what they get back. Callers that only
+// read (e.g. Nodes/Belongs) should use Get instead to skip the copy cost.
+func (c *TimedCache) GetWithDeepCopy(key string, readType ReadType) (interface{}, error) {
+	data, err := c.Get(key, readType)
+	if err != nil {
+		return nil, err
+	}
+	return deepCopy(data)
+}
+
+// Set stores value for key directly, without going through the getter, and
+// marks it as freshly updated. Used by callers that just performed a
+// mutation and already know its result (e.g. a proactively updated capacity).
+func (c *TimedCache) Set(key string, value interface{}) {
+	e := c.entryFor(key)
+
+	e.dataMutex.Lock()
+	defer e.dataMutex.Unlock()
+
+	e.data = value
+	e.populated = true
+	e.lastUpdate = time.Now()
+}
+
+// Delete invalidates key so the next Get, whatever its ReadType, fetches a
+// fresh value.
+func (c *TimedCache) Delete(key string) {
+	e := c.entryFor(key)
+
+	e.dataMutex.Lock()
+	defer e.dataMutex.Unlock()
+
+	e.populated = false
+	e.data = nil
+}
+
+// deepCopy recursively copies value using reflection, so callers can't
+// observe (or corrupt) another caller's cached struct/slice/map through a
+// shared pointer. It is generic enough for the compute.* ARM structs we
+// cache, which are plain structs/slices/maps/pointers of basic types.
+func deepCopy(value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	return deepCopyValue(reflect.ValueOf(value)).Interface(), nil
+}
+
+func deepCopyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type().Elem())
+		out.Elem().Set(deepCopyValue(v.Elem()))
+		return out
+	case reflect.Struct:
+		out := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if !out.Field(i).CanSet() {
+				continue
+			}
+			out.Field(i).Set(deepCopyValue(v.Field(i)))
+		}
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(deepCopyValue(v.Index(i)))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, k := range v.MapKeys() {
+			out.SetMapIndex(k, deepCopyValue(v.MapIndex(k)))
+		}
+		return out
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type()).Elem()
+		out.Set(deepCopyValue(v.Elem()))
+		return out
+	default:
+		return v
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeValue struct {
+	Count int
+}
+
+func TestTimedCacheReadTypeDefault(t *testing.T) {
+	calls := 0
+	c := NewTimedCache(time.Hour, func(key string) (interface{}, error) {
+		calls++
+		return &fakeValue{Count: calls}, nil
+	})
+
+	v1, err := c.Get("k", ReadTypeDefault)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v1.(*fakeValue).Count)
+
+	// Still within TTL: no new fetch.
+	v2, err := c.Get("k", ReadTypeDefault)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v2.(*fakeValue).Count)
+	assert.Equal(t, 1, calls)
+}
+
+func TestTimedCacheReadTypeUnsafe(t *testing.T) {
+	calls := 0
+	c := NewTimedCache(time.Nanosecond, func(key string) (interface{}, error) {
+		calls++
+		return &fakeValue{Count: calls}, nil
+	})
+
+	_, err := c.Get("k", ReadTypeDefault)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond)
+
+	// Even though the TTL has long since expired, Unsafe returns the stale
+	// cached value without triggering another fetch.
+	v, err := c.Get("k", ReadTypeUnsafe)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v.(*fakeValue).Count)
+	assert.Equal(t, 1, calls)
+}
+
+func TestTimedCacheReadTypeForceRefresh(t *testing.T) {
+	calls := 0
+	c := NewTimedCache(time.Hour, func(key string) (interface{}, error) {
+		calls++
+		return &fakeValue{Count: calls}, nil
+	})
+
+	_, err := c.Get("k", ReadTypeDefault)
+	assert.NoError(t, err)
+
+	v, err := c.Get("k", ReadTypeForceRefresh)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v.(*fakeValue).Count)
+	assert.Equal(t, 2, calls)
+}
+
+func TestTimedCacheReadTypeUnsafeDoesNotBlockOnInFlightFetch(t *testing.T) {
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	calls := 0
+	c := NewTimedCache(time.Nanosecond, func(key string) (interface{}, error) {
+		calls++
+		if calls == 2 {
+			close(fetching)
+			<-release
+		}
+		return &fakeValue{Count: calls}, nil
+	})
+
+	_, err := c.Get("k", ReadTypeDefault)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = c.Get("k", ReadTypeDefault)
+	}()
+	<-fetching
+
+	unsafeDone := make(chan interface{}, 1)
+	go func() {
+		v, err := c.Get("k", ReadTypeUnsafe)
+		assert.NoError(t, err)
+		unsafeDone <- v
+	}()
+
+	select {
+	case v := <-unsafeDone:
+		assert.Equal(t, 1, v.(*fakeValue).Count)
+	case <-time.After(time.Second):
+		t.Fatal("ReadTypeUnsafe blocked behind an in-flight live fetch")
+	}
+
+	close(release)
+	<-done
+}
+
+func TestTimedCacheSet(t *testing.T) {
+	c := NewTimedCache(time.Hour, func(key string) (interface{}, error) {
+		t.Fatal("getter should not be called after Set")
+		return nil, nil
+	})
+
+	c.Set("k", &fakeValue{Count: 42})
+
+	v, err := c.Get("k", ReadTypeUnsafe)
+	assert.NoError(t, err)
+	assert.Equal(t, 42, v.(*fakeValue).Count)
+}
+
+func TestTimedCacheGetWithDeepCopy(t *testing.T) {
+	c := NewTimedCache(time.Hour, func(key string) (interface{}, error) {
+		return &fakeValue{Count: 1}, nil
+	})
+
+	copied, err := c.GetWithDeepCopy("k", ReadTypeDefault)
+	assert.NoError(t, err)
+	copied.(*fakeValue).Count = 99
+
+	original, err := c.Get("k", ReadTypeUnsafe)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, original.(*fakeValue).Count)
+}